@@ -0,0 +1,596 @@
+package main
+
+// Native KF8 (AZW3) writer. The file is a PalmDB container: record 0 holds
+// the MOBI 8 header and EXTH metadata, followed by the text records, the
+// fragment, skeleton and NCX indices, the images and the FDST, FLIS, FCIS
+// and EOF records. Every section is stored as one skeleton (the empty xhtml
+// page) and one fragment (the body content inserted into it).
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/bits"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterWriter("azw3", writerFunc{".azw3", WriteAzw3})
+}
+
+const (
+	kf8RecordSize     = 4096
+	kf8IndexHeaderLen = 192
+	kf8NullIndex      = 0xFFFFFFFF
+	kf8Base32Digits   = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+)
+
+var (
+	kf8ImgRe  = regexp.MustCompile(`(<img\b[^>]*?\bsrc=")\.\./images/([^"]+)"`)
+	kf8HrefRe = regexp.MustCompile(`\shref="([^"]*)"`)
+)
+
+var kf8Languages = map[string]int{
+	"zh": 4, "de": 7, "en": 9, "es": 10, "fr": 12,
+	"it": 16, "ja": 17, "nl": 19, "pt": 22, "ru": 25,
+}
+
+// kf8Tag describes one tag of an index entry, see the TAGX section
+type kf8Tag struct {
+	name           string
+	number         byte
+	valuesPerEntry byte
+	mask           byte
+	endFlag        byte
+}
+
+var kf8EndTag = kf8Tag{endFlag: 1}
+
+type kf8Entry struct {
+	label  string
+	values map[string][]int
+}
+
+type kf8Index struct {
+	tags         []kf8Tag
+	controlBytes int
+	entries      []kf8Entry
+	cncx         [][]byte
+}
+
+var (
+	kf8SkelTags = []kf8Tag{
+		{name: "chunk_count", number: 1, valuesPerEntry: 1, mask: 3},
+		{name: "geometry", number: 6, valuesPerEntry: 2, mask: 12},
+		kf8EndTag,
+	}
+	kf8FragTags = []kf8Tag{
+		{name: "cncx_offset", number: 2, valuesPerEntry: 1, mask: 1},
+		{name: "file_number", number: 3, valuesPerEntry: 1, mask: 2},
+		{name: "sequence_number", number: 4, valuesPerEntry: 1, mask: 4},
+		{name: "geometry", number: 6, valuesPerEntry: 2, mask: 8},
+		kf8EndTag,
+	}
+	kf8NcxTags = []kf8Tag{
+		{name: "offset", number: 1, valuesPerEntry: 1, mask: 1},
+		{name: "length", number: 2, valuesPerEntry: 1, mask: 2},
+		{name: "label", number: 3, valuesPerEntry: 1, mask: 4},
+		{name: "depth", number: 4, valuesPerEntry: 1, mask: 8},
+		{name: "parent", number: 21, valuesPerEntry: 1, mask: 16},
+		{name: "first_child", number: 22, valuesPerEntry: 1, mask: 32},
+		{name: "last_child", number: 23, valuesPerEntry: 1, mask: 64},
+		{name: "pos_fid", number: 6, valuesPerEntry: 2, mask: 128},
+		kf8EndTag,
+		{name: "image", number: 69, valuesPerEntry: 1, mask: 1},
+		{name: "description", number: 70, valuesPerEntry: 1, mask: 2},
+		{name: "author", number: 71, valuesPerEntry: 1, mask: 4},
+		{name: "caption", number: 72, valuesPerEntry: 1, mask: 8},
+		{name: "attribution", number: 73, valuesPerEntry: 1, mask: 16},
+		kf8EndTag,
+	}
+)
+
+// kf8Base32 formats n the way kindle:embed, kindle:flow and aid values expect
+func kf8Base32(n int, digits int) string {
+	s := ""
+	for n > 0 {
+		s = string(kf8Base32Digits[n%32]) + s
+		n /= 32
+	}
+	for len(s) < digits {
+		s = "0" + s
+	}
+	return s
+}
+
+// kf8Encint is the forward variable width integer of MOBI indices, seven
+// bits per byte with the high bit set on the last byte
+func kf8Encint(value int) []byte {
+	b := []byte{byte(value&0x7f) | 0x80}
+	for value >>= 7; value > 0; value >>= 7 {
+		b = append([]byte{byte(value & 0x7f)}, b...)
+	}
+	return b
+}
+
+func kf8Align(b []byte) []byte {
+	if pad := len(b) % 4; pad != 0 {
+		b = append(b, make([]byte, 4-pad)...)
+	}
+	return b
+}
+
+func kf8Put(buf *bytes.Buffer, values ...uint32) {
+	for _, v := range values {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// kf8CNCX stores the index strings and returns their offsets
+func kf8CNCX(strs []string) ([][]byte, map[string]int) {
+	const limit = 0x10000 - 1024
+	var records [][]byte
+	offsets := map[string]int{}
+	var buf bytes.Buffer
+	for _, s := range strs {
+		if _, ok := offsets[s]; ok {
+			continue
+		}
+		value := s
+		if len(value) > 500 {
+			value = value[:500]
+		}
+		raw := append(kf8Encint(len(value)), value...)
+		if buf.Len()+len(raw) > limit {
+			records = append(records, kf8Align(append([]byte(nil), buf.Bytes()...)))
+			buf.Reset()
+		}
+		offsets[s] = len(records)*0x10000 + buf.Len()
+		buf.Write(raw)
+	}
+	if buf.Len() > 0 {
+		records = append(records, kf8Align(buf.Bytes()))
+	}
+	return records, offsets
+}
+
+func (idx *kf8Index) tagx() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("TAGX")
+	kf8Put(&buf, uint32(12+4*len(idx.tags)), uint32(idx.controlBytes))
+	for _, tag := range idx.tags {
+		buf.Write([]byte{tag.number, tag.valuesPerEntry, tag.mask, tag.endFlag})
+	}
+	return buf.Bytes()
+}
+
+func (idx *kf8Index) controlBytesFor(entry kf8Entry) []byte {
+	cb := make([]byte, idx.controlBytes)
+	i := 0
+	for _, tag := range idx.tags {
+		if tag.endFlag == 1 {
+			i++
+			continue
+		}
+		n := len(entry.values[tag.name]) / int(tag.valuesPerEntry)
+		if n > 0 {
+			cb[i] |= byte(n<<bits.TrailingZeros8(tag.mask)) & tag.mask
+		}
+	}
+	return cb
+}
+
+// records renders the index header record, the entry record and the CNCX
+func (idx *kf8Index) records() ([][]byte, error) {
+	var data, idxt bytes.Buffer
+	last := ""
+	for _, entry := range idx.entries {
+		binary.Write(&idxt, binary.BigEndian, uint16(kf8IndexHeaderLen+data.Len()))
+		data.WriteByte(byte(len(entry.label)))
+		data.WriteString(entry.label)
+		data.Write(idx.controlBytesFor(entry))
+		for _, tag := range idx.tags {
+			for _, v := range entry.values[tag.name] {
+				data.Write(kf8Encint(v))
+			}
+		}
+		last = entry.label
+	}
+	body := kf8Align(data.Bytes())
+	idxtBlock := kf8Align(append([]byte("IDXT"), idxt.Bytes()...))
+	if kf8IndexHeaderLen+len(body)+len(idxtBlock) >= 0x10000 {
+		return nil, fmt.Errorf("azw3: index with %d entries does not fit in one record", len(idx.entries))
+	}
+
+	var rec bytes.Buffer
+	rec.WriteString("INDX")
+	kf8Put(&rec, kf8IndexHeaderLen, 0, 1, 0, uint32(kf8IndexHeaderLen+len(body)), uint32(len(idx.entries)))
+	rec.Write(bytes.Repeat([]byte{0xff}, 8))
+	rec.Write(make([]byte, 156))
+	rec.Write(body)
+	rec.Write(idxtBlock)
+
+	tagx := idx.tagx()
+	lastIndex := append([]byte{byte(len(last))}, last...)
+	lastIndex = kf8Align(append(lastIndex, byte(len(idx.entries)>>8), byte(len(idx.entries))))
+
+	var head bytes.Buffer
+	head.WriteString("INDX")
+	kf8Put(&head, kf8IndexHeaderLen, 0, 0, 2, uint32(kf8IndexHeaderLen+len(tagx)+len(lastIndex)),
+		1, 65001, kf8NullIndex, uint32(len(idx.entries)), 0, 0, 0, uint32(len(idx.cncx)))
+	head.Write(make([]byte, 124))
+	kf8Put(&head, kf8IndexHeaderLen, 0, 0)
+	head.Write(tagx)
+	head.Write(lastIndex)
+	head.WriteString("IDXT")
+	binary.Write(&head, binary.BigEndian, uint16(kf8IndexHeaderLen+len(tagx)))
+	head.WriteByte(0)
+
+	return append([][]byte{kf8Align(head.Bytes()), rec.Bytes()}, idx.cncx...), nil
+}
+
+func kf8MediaType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".svg":
+		return "image/svg+xml"
+	}
+	return "image/jpeg"
+}
+
+// kf8Body rewrites a section for KF8: images become kindle:embed references
+// and links to pages that are not part of the file are dropped
+func kf8Body(body string, embeds map[string]int) string {
+	body = kf8ImgRe.ReplaceAllStringFunc(body, func(m string) string {
+		parts := kf8ImgRe.FindStringSubmatch(m)
+		n, ok := embeds[parts[2]]
+		if !ok {
+			return m
+		}
+		return parts[1] + "kindle:embed:" + kf8Base32(n, 4) + "?mime=" + kf8MediaType(parts[2]) + `"`
+	})
+	body = kf8HrefRe.ReplaceAllStringFunc(body, func(m string) string {
+		href := kf8HrefRe.FindStringSubmatch(m)[1]
+		if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "mailto:") {
+			return m
+		}
+		return ""
+	})
+	return cleanXHTML(body)
+}
+
+// kf8TextRecords splits the text into 4096 byte records. A record cut inside
+// a multibyte character carries the rest of it as trailing data.
+func kf8TextRecords(text []byte) [][]byte {
+	var records [][]byte
+	for pos := 0; pos < len(text); pos += kf8RecordSize {
+		end := pos + kf8RecordSize
+		if end > len(text) {
+			end = len(text)
+		}
+		record := append([]byte(nil), text[pos:end]...)
+		overlap := 0
+		if end < len(text) {
+			start := end - 1
+			for start > pos && !utf8.RuneStart(text[start]) {
+				start--
+			}
+			if _, size := utf8.DecodeRune(text[start:]); start+size > end {
+				overlap = start + size - end
+			}
+		}
+		record = append(record, text[end:end+overlap]...)
+		records = append(records, append(record, byte(overlap)))
+	}
+	return records
+}
+
+func kf8Exth(book *Book, resources int, cover int) []byte {
+	var recs bytes.Buffer
+	count := 0
+	add := func(kind uint32, data []byte) {
+		kf8Put(&recs, kind, uint32(8+len(data)))
+		recs.Write(data)
+		count++
+	}
+	addInt := func(kind uint32, value int) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(value))
+		add(kind, b[:])
+	}
+
+	add(100, []byte(book.Author))
+	if book.Summary.Publisher != "" {
+		add(101, []byte(book.Summary.Publisher))
+	}
+	if book.Description != "" {
+		add(103, []byte(book.Description))
+	}
+	add(104, []byte(book.Identifier))
+	if !book.Summary.PublicationDate.IsZero() {
+		add(106, []byte(book.Summary.PublicationDate.Format(time.RFC3339)))
+	}
+	add(113, []byte(book.Identifier))
+	add(501, []byte("EBOK"))
+	add(503, []byte(book.Title))
+	add(524, []byte(book.Language))
+	addInt(125, resources)
+	if cover >= 0 {
+		addInt(201, cover)
+		addInt(203, 0)
+	}
+
+	var exth bytes.Buffer
+	exth.WriteString("EXTH")
+	kf8Put(&exth, uint32(12+recs.Len()), uint32(count))
+	exth.Write(recs.Bytes())
+	return kf8Align(exth.Bytes())
+}
+
+func kf8Record0(book *Book, textLength int, indices map[string]uint32, exth []byte) []byte {
+	title := []byte(book.Title)
+	language, ok := kf8Languages[book.Language]
+	if !ok {
+		language = kf8Languages["en"]
+	}
+
+	var r bytes.Buffer
+	// PalmDOC header, no compression
+	binary.Write(&r, binary.BigEndian, []uint16{1, 0})
+	kf8Put(&r, uint32(textLength))
+	binary.Write(&r, binary.BigEndian, []uint16{uint16(indices["last_text"]), kf8RecordSize, 0, 0})
+
+	r.WriteString("MOBI")
+	kf8Put(&r, 264, 2, 65001, crc32.ChecksumIEEE([]byte(book.Identifier)), 8)
+	kf8Put(&r, kf8NullIndex, kf8NullIndex)
+	for i := 0; i < 8; i++ {
+		kf8Put(&r, kf8NullIndex)
+	}
+	kf8Put(&r, indices["first_non_text"], uint32(280+len(exth)), uint32(len(title)), uint32(language), 0, 0, 8)
+	kf8Put(&r, indices["first_resource"], 0, 0, 0, 0, 0x50)
+	r.Write(make([]byte, 32))
+	kf8Put(&r, kf8NullIndex, kf8NullIndex, 0, 0, 0, 0, 0)
+	kf8Put(&r, indices["fdst"], indices["fdst_count"], indices["fcis"], 1, indices["flis"], 1, 0, 0)
+	kf8Put(&r, kf8NullIndex, 0, kf8NullIndex, kf8NullIndex)
+	kf8Put(&r, 1, indices["ncx"], indices["chunk"], indices["skel"], kf8NullIndex, kf8NullIndex)
+	kf8Put(&r, kf8NullIndex, 0, kf8NullIndex, 0)
+
+	r.Write(exth)
+	r.Write(title)
+	r.Write(make([]byte, 8192))
+	return r.Bytes()
+}
+
+func kf8PalmDB(name string, records [][]byte, created time.Time) []byte {
+	var buf bytes.Buffer
+	title := make([]byte, 32)
+	clean := strings.Map(func(r rune) rune {
+		if r > 127 || r < 32 || r == ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(clean) > 31 {
+		clean = clean[:31]
+	}
+	copy(title, clean)
+	buf.Write(title)
+
+	now := uint32(created.Unix())
+	binary.Write(&buf, binary.BigEndian, []uint16{0, 0})
+	kf8Put(&buf, now, now, 0, 0, 0, 0)
+	buf.WriteString("BOOKMOBI")
+	kf8Put(&buf, uint32(2*len(records)-1), 0)
+	binary.Write(&buf, binary.BigEndian, uint16(len(records)))
+
+	offset := buf.Len() + 8*len(records) + 2
+	for i, record := range records {
+		kf8Put(&buf, uint32(offset), uint32(2*i)&0x00FFFFFF)
+		offset += len(record)
+	}
+	buf.Write([]byte{0, 0})
+	for _, record := range records {
+		buf.Write(record)
+	}
+	return buf.Bytes()
+}
+
+// kf8NcxEntries lays the sections out breadth first, chapters then their
+// sections, as the Kindle expects for a hierarchical table of contents
+func kf8NcxEntries(book *Book, positions []int, textEnd int, labels map[string]int) []kf8Entry {
+	var chapters []int
+	children := map[int][]int{}
+	parentOf := map[int]int{}
+	parent := -1
+	for i, section := range book.Sections {
+		if section.Level == 0 || parent < 0 {
+			chapters = append(chapters, i)
+			parent = i
+			continue
+		}
+		children[parent] = append(children[parent], i)
+		parentOf[i] = parent
+	}
+
+	order := append([]int(nil), chapters...)
+	for _, chapter := range chapters {
+		order = append(order, children[chapter]...)
+	}
+	index := map[int]int{}
+	for i, section := range order {
+		index[section] = i
+	}
+
+	next := func(section int, chapterOnly bool) int {
+		for j := section + 1; j < len(book.Sections); j++ {
+			if !chapterOnly || book.Sections[j].Level == 0 {
+				return positions[j]
+			}
+		}
+		return textEnd
+	}
+
+	var entries []kf8Entry
+	for _, section := range order {
+		chapter, isSection := parentOf[section]
+		values := map[string][]int{
+			"offset":  {positions[section]},
+			"length":  {next(section, !isSection) - positions[section]},
+			"label":   {labels[book.Sections[section].Title]},
+			"depth":   {0},
+			"pos_fid": {section, 0},
+		}
+		if kids := children[section]; len(kids) > 0 {
+			values["first_child"] = []int{index[kids[0]]}
+			values["last_child"] = []int{index[kids[len(kids)-1]]}
+		}
+		if isSection {
+			values["depth"] = []int{1}
+			values["parent"] = []int{index[chapter]}
+		}
+		entries = append(entries, kf8Entry{label: fmt.Sprintf("%02x", index[section]), values: values})
+	}
+	return entries
+}
+
+// WriteAzw3 writes the book as a KF8 only AZW3 file
+func WriteAzw3(book *Book, path string) error {
+	book = SimplifyBook(book, "AZW3")
+
+	// resources, the cover is always the first one
+	var resources [][]byte
+	embeds := map[string]int{}
+	cover := -1
+	if book.Cover != "" {
+		data, err := ioutil.ReadFile(book.Cover)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, data)
+		cover = 0
+	}
+	for _, image := range book.Assets {
+		data, err := ioutil.ReadFile(image.Path)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, data)
+		embeds[image.Name] = len(resources)
+	}
+
+	css := "img { max-width: 100%; }\n" + book.CSS
+	head := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<html xmlns="http://www.w3.org/1999/xhtml"><head><title>%s</title>` +
+		`<meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>` +
+		`<link href="kindle:flow:0001?mime=text/css" rel="stylesheet" type="text/css"/>` +
+		`</head><body aid="%s">`
+
+	var text bytes.Buffer
+	skel := &kf8Index{tags: kf8SkelTags, controlBytes: 1}
+	frag := &kf8Index{tags: kf8FragTags, controlBytes: 1}
+	var selectors, titles []string
+	positions := make([]int, len(book.Sections))
+	for i, section := range book.Sections {
+		aid := kf8Base32(i, 4)
+		skeleton := fmt.Sprintf(head, xhtmlEscaper.Replace(section.Title), aid)
+		insert := len(skeleton)
+		skeleton += "</body></html>"
+		chunk := kf8Body(section.Body, embeds)
+
+		start := text.Len()
+		text.WriteString(skeleton)
+		text.WriteString(chunk)
+		positions[i] = start + insert
+
+		skel.entries = append(skel.entries, kf8Entry{
+			label: fmt.Sprintf("SKEL%010d", i),
+			values: map[string][]int{
+				"chunk_count": {1, 1},
+				"geometry":    {start, len(skeleton), start, len(skeleton)},
+			},
+		})
+		selector := "P-//*[@aid='" + aid + "']"
+		selectors = append(selectors, selector)
+		titles = append(titles, section.Title)
+		frag.entries = append(frag.entries, kf8Entry{
+			label: fmt.Sprintf("%010d", start+insert),
+			values: map[string][]int{
+				"file_number":     {i},
+				"sequence_number": {i},
+				"geometry":        {0, len(chunk)},
+			},
+		})
+	}
+	textEnd := text.Len()
+	text.WriteString(css)
+
+	var offsets map[string]int
+	frag.cncx, offsets = kf8CNCX(selectors)
+	for i := range frag.entries {
+		frag.entries[i].values["cncx_offset"] = []int{offsets[selectors[i]]}
+	}
+	ncx := &kf8Index{tags: kf8NcxTags, controlBytes: 2}
+	ncx.cncx, offsets = kf8CNCX(titles)
+	ncx.entries = kf8NcxEntries(book, positions, textEnd, offsets)
+
+	records := [][]byte{nil}
+	size := 0
+	for _, record := range kf8TextRecords(text.Bytes()) {
+		records = append(records, record)
+		size += len(record)
+	}
+	indices := map[string]uint32{"last_text": uint32(len(records) - 1)}
+	if size%4 != 0 {
+		records = append(records, make([]byte, 4-size%4))
+	}
+	indices["first_non_text"] = uint32(len(records))
+
+	for _, index := range []struct {
+		name string
+		idx  *kf8Index
+	}{{"chunk", frag}, {"skel", skel}, {"ncx", ncx}} {
+		rendered, err := index.idx.records()
+		if err != nil {
+			return err
+		}
+		indices[index.name] = uint32(len(records))
+		records = append(records, rendered...)
+	}
+
+	indices["first_resource"] = kf8NullIndex
+	if len(resources) > 0 {
+		indices["first_resource"] = uint32(len(records))
+		records = append(records, resources...)
+	}
+
+	var fdst bytes.Buffer
+	fdst.WriteString("FDST")
+	kf8Put(&fdst, 12, 2, 0, uint32(textEnd), uint32(textEnd), uint32(text.Len()))
+	indices["fdst"] = uint32(len(records))
+	indices["fdst_count"] = 2
+	records = append(records, fdst.Bytes())
+
+	indices["flis"] = uint32(len(records))
+	records = append(records, []byte("FLIS\x00\x00\x00\x08\x00\x41\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\x00\x01\x00\x03\x00\x00\x00\x03\x00\x00\x00\x01\xff\xff\xff\xff"))
+
+	var fcis bytes.Buffer
+	fcis.WriteString("FCIS\x00\x00\x00\x14\x00\x00\x00\x10\x00\x00\x00\x02\x00\x00\x00\x00")
+	kf8Put(&fcis, uint32(text.Len()))
+	fcis.WriteString("\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x00\x00\x00\x00\x28\x00\x00\x00\x08\x00\x01\x00\x01\x00\x00\x00\x00")
+	indices["fcis"] = uint32(len(records))
+	records = append(records, fcis.Bytes())
+
+	records = append(records, []byte{0xe9, 0x8e, '\r', '\n'})
+
+	records[0] = kf8Record0(book, text.Len(), indices, kf8Exth(book, len(resources), cover))
+	return ioutil.WriteFile(path, kf8PalmDB(book.Title, records, buildTime(book)), 0644)
+}
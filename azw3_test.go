@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKf8Encint(t *testing.T) {
+	tests := []struct {
+		value int
+		want  []byte
+	}{
+		{0, []byte{0x80}},
+		{1, []byte{0x81}},
+		{0x7f, []byte{0xff}},
+		{0x80, []byte{0x01, 0x80}},
+		{300, []byte{0x02, 0xac}},
+		{1 << 14, []byte{0x01, 0x00, 0x80}},
+	}
+	for _, tt := range tests {
+		if got := kf8Encint(tt.value); !bytes.Equal(got, tt.want) {
+			t.Errorf("kf8Encint(%d) = % x, want % x", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmaupin/go-epub"
+)
+
+// Book is a downloaded title that can be written in any output format
+type Book struct {
+	Title        string
+	Author       string
+	Description  string
+	Identifier   string
+	Language     string
+	Summary      Summary
+	Cover        string
+	CSS          string
+	Sections     []Section
+	Assets       []Asset
+	Missing      []MissingImage
+	Toc          TOC
+	Fingerprints map[string]string // SHA-256 of the html of every section, by chapter/section id
+
+	fetched map[string]bool  // image URLs downloaded to an asset
+	failed  map[string]error // image URLs that could not be downloaded
+}
+
+// MissingImage is an image that could not be downloaded
+type MissingImage struct {
+	Section string
+	URL     string
+	Err     error
+}
+
+// Section is a page of the book, level 0 sections start a chapter
+type Section struct {
+	Title   string
+	Level   int
+	Part    string // "preface", "chapter" or "appendix"
+	Chapter int    // index of the chapter within its part
+	Body    string
+}
+
+// Asset is a downloaded image, sections refer to it as ../images/<Name>
+type Asset struct {
+	Name string
+	Path string
+}
+
+func init() {
+	RegisterWriter("epub", writerFunc{".epub", writeValidatedEpub})
+}
+
+// NavPoint is an entry of the table of contents pointing at a section
+type NavPoint struct {
+	Title    string
+	Section  int
+	Children []NavPoint
+}
+
+// Nav returns the table of contents, chapters with their sections nested
+func (book *Book) Nav() []NavPoint {
+	var nav []NavPoint
+	for i, section := range book.Sections {
+		point := NavPoint{Title: section.Title, Section: i}
+		if section.Level > 0 && len(nav) > 0 {
+			last := &nav[len(nav)-1]
+			last.Children = append(last.Children, point)
+			continue
+		}
+		nav = append(nav, point)
+	}
+	return nav
+}
+
+// FetchBook downloads the metadata, cover, sections and images of a title
+func FetchBook(token string, isbn string) (*Book, error) {
+	book, err := FetchMetadata(isbn)
+	if err != nil {
+		return nil, err
+	}
+	if err := FetchContent(token, book); err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// FetchMetadata fills the title, author and description of a book
+func FetchMetadata(isbn string) (*Book, error) {
+	summary, err := GetSummary(isbn)
+	if err != nil {
+		return nil, err
+	}
+	author := ""
+	if len(summary.Authors) > 0 {
+		a, err := GetAuthor(summary.Authors[0])
+		if err != nil {
+			return nil, err
+		}
+		author = a.Author
+	}
+	return &Book{
+		Title:       summary.Title,
+		Author:      author,
+		Description: summary.About,
+		Identifier:  isbn,
+		Language:    "en",
+		Summary:     summary,
+	}, nil
+}
+
+// FetchContent downloads the cover, sections and images of a book
+func FetchContent(token string, book *Book) error {
+	isbn := book.Identifier
+	toc, err := GetToc(isbn)
+	if err != nil {
+		return err
+	}
+
+	if err := FetchCover(book); err != nil {
+		return err
+	}
+
+	highlight := highlightConfig()
+	if highlight.Theme != "none" {
+		book.CSS = HighlightCSS(highlight)
+	}
+
+	book.CSS += contentCSS
+
+	book.fetched = map[string]bool{}
+	book.failed = map[string]error{}
+	book.Toc = toc
+	book.Fingerprints = map[string]string{}
+	err = WalkToc(token, isbn, toc, func(part string, chapter int, section int, title string, page string) {
+		book.Fingerprints[toc.SectionKey(part, chapter, section)] = fingerprint(page)
+		pageData := fixImages(book, title, page)
+		level := 1
+		if section == 0 {
+			level = 0
+		}
+		book.Sections = append(book.Sections, Section{
+			Title:   title,
+			Level:   level,
+			Part:    part,
+			Chapter: chapter,
+			Body:    prepareContent(HighlightSection(pageData, highlight)),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(book.Missing) > 0 {
+		book.CSS += "\n.missing-image { display: block; border: 1px dashed #999; padding: 0.5em; text-align: center; font-style: italic; }\n"
+	}
+
+	report, err := OptimizeImages(book)
+	if err != nil {
+		return err
+	}
+	if report.Duplicates > 0 || report.Before != report.After {
+		fmt.Println("Images : " + report.String())
+	}
+	return nil
+}
+
+// WriteEpub writes the book as an EPUB file
+func WriteEpub(book *Book, path string) error {
+	e := epub.NewEpub(book.Title)
+	e.SetAuthor(book.Author)
+	e.SetDescription(book.Description)
+	e.SetIdentifier(book.Identifier)
+	e.SetLang(book.Language)
+
+	if book.Cover != "" {
+		coverImagePath, err := e.AddImage(book.Cover, filepath.Base(book.Cover))
+		if err != nil {
+			return err
+		}
+		e.SetCover(coverImagePath, "")
+	}
+
+	cssPath := ""
+	if book.CSS != "" {
+		cssFile := tempPath("code.css")
+		if err := ioutil.WriteFile(cssFile, []byte(book.CSS), 0644); err != nil {
+			return err
+		}
+		var err error
+		if cssPath, err = e.AddCSS(cssFile, "code.css"); err != nil {
+			return err
+		}
+	}
+
+	for _, image := range book.Assets {
+		if _, err := e.AddImage(image.Path, "../images/"+image.Name); err != nil {
+			return fmt.Errorf("image %s: %v", image.Name, err)
+		}
+	}
+	for _, section := range book.Sections {
+		if _, err := e.AddSection(section.Body, section.Title, "", cssPath); err != nil {
+			return fmt.Errorf("section %q: %v", section.Title, err)
+		}
+	}
+	raw := tempPath(filepath.Base(path) + ".raw")
+	if err := e.Write(raw); err != nil {
+		return err
+	}
+	if !deterministic() {
+		return fixEpubPackage(raw, path)
+	}
+	fixed := tempPath(filepath.Base(path) + ".fixed")
+	if err := fixEpubPackage(raw, fixed); err != nil {
+		return err
+	}
+	return normalizeEpub(fixed, path, buildTime(book))
+}
+
+// rewriteZip copies a zip file passing every entry through fn, the mimetype
+// entry of an EPUB stays first and uncompressed
+func rewriteZip(src string, dst string, fn func(name string, data []byte) []byte) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := zip.NewWriter(out)
+	for _, f := range r.File {
+		header := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified}
+		if f.Name == "mimetype" {
+			header.Method = zip.Store
+		}
+		rc, err := f.Open()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := fw.Write(fn(f.Name, data)); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// void elements have no content and are written self-closed in XHTML
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+var xhtmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;")
+
+// cleanXHTML turns a section html fragment into well-formed XHTML, closing
+// void elements and resolving html entities. When the fragment cannot be
+// read to the end, the text of the rest is kept and open elements are closed
+func cleanXHTML(in string) string {
+	d := xml.NewDecoder(strings.NewReader(in))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var out strings.Builder
+	var open []string
+	skipEnd := ""
+	for {
+		offset := d.InputOffset()
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rest := html.UnescapeString(tagRe.ReplaceAllString(in[offset:], " "))
+			out.WriteString(xhtmlEscaper.Replace(strings.Join(strings.Fields(rest), " ")))
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := xmlName(t.Name)
+			out.WriteString("<" + name)
+			for _, attr := range t.Attr {
+				out.WriteString(" " + xmlName(attr.Name) + `="` + attrEscaper.Replace(attr.Value) + `"`)
+			}
+			if voidElements[strings.ToLower(name)] {
+				out.WriteString("/>")
+				skipEnd = name
+				continue
+			}
+			out.WriteString(">")
+			open = append(open, name)
+		case xml.EndElement:
+			name := xmlName(t.Name)
+			if skipEnd != "" && name == skipEnd {
+				skipEnd = ""
+				continue
+			}
+			out.WriteString("</" + name + ">")
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		case xml.CharData:
+			out.WriteString(xhtmlEscaper.Replace(string(t)))
+		}
+		skipEnd = ""
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space != "" && name.Space != "xmlns" && !strings.Contains(name.Space, "/") {
+		return name.Space + ":" + name.Local
+	}
+	if name.Space == "xmlns" {
+		return "xmlns:" + name.Local
+	}
+	return name.Local
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCleanXHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"void elements", `<p>a<br>b<img src="x.png"></p>`, `<p>a<br/>b<img src="x.png"/></p>`},
+		{"entities", `<p>&nbsp;&lt;tag&gt; &amp; &copy;</p>`, "<p> &lt;tag&gt; &amp; ©</p>"},
+		{"attributes", `<a href="?a=1&amp;b=&quot;2&quot;">x</a>`, `<a href="?a=1&amp;b=&quot;2&quot;">x</a>`},
+		{"unclosed element", `<div><p>one</p>`, `<div><p>one</p></div>`},
+		{"unterminated attribute", `<p>one</p><p class="x>two &amp; <em>three</em></p>`, `<p>one</p>two &amp; three`},
+		{"stray end tag", `<p>one <b>two</b></p></div><p>three &lt;4&gt;</p>`, `<p>one <b>two</b></p>three &lt;4&gt;`},
+		{"open elements closed", `<div><p>one <b>two</p>`, `<div><p>one <b>two</b></p></div>`},
+	}
+	for _, tt := range tests {
+		if got := cleanXHTML(tt.in); got != tt.want {
+			t.Errorf("%s: cleanXHTML(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
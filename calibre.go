@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var calibreAddedRe = regexp.MustCompile(`(?i)added book ids?:\s*([0-9]+)`)
+
+// calibreDB runs calibredb commands on the library of --calibre-library
+type calibreDB struct {
+	Path    string
+	Library string
+}
+
+// newCalibreDB finds calibredb, nil when no Calibre library is configured
+func newCalibreDB() (*calibreDB, error) {
+	library := flagValue("calibre-library", "")
+	if library == "" {
+		return nil, nil
+	}
+	path, err := findCalibreTool("calibredb")
+	if err != nil {
+		return nil, err
+	}
+	return &calibreDB{Path: path, Library: library}, nil
+}
+
+func (c *calibreDB) run(args ...string) (string, error) {
+	args = append(args, "--with-library", c.Library)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.Path, args...) // #nosec G204 -- calibredb is picked by the user
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("calibredb %s: %v\n%s", args[0], err, lastLines(stderr.String(), 20))
+	}
+	return stdout.String(), nil
+}
+
+// findISBN returns the id of the book with an ISBN, 0 when there is none
+func (c *calibreDB) findISBN(isbn string) (int, error) {
+	out, err := c.run("list", "--search", "identifiers:isbn:"+isbn, "--fields", "id", "--for-machine")
+	if err != nil {
+		return 0, err
+	}
+	var books []struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(out), &books); err != nil {
+		return 0, fmt.Errorf("calibredb list: %v", err)
+	}
+	if len(books) == 0 {
+		return 0, nil
+	}
+	return books[0].ID, nil
+}
+
+// calibreTags are the tags of a book: the concept, tool, language and
+// category Packt files it under
+func calibreTags(summary Summary) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range []string{
+		summary.Meta.Concepts.ConceptName,
+		summary.Meta.Tool.ToolName,
+		summary.Meta.Language.LanguageName,
+		summary.Meta.Category.CategoryName,
+		summary.Category,
+	} {
+		tag = strings.TrimSpace(strings.Replace(tag, ",", " ", -1))
+		if tag != "" && !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// calibreFields is the metadata set on the book, editions of a title are
+// grouped as a series
+func calibreFields(book *Book) []string {
+	publisher := book.Summary.Publisher
+	if publisher == "" {
+		publisher = "Packt Publishing"
+	}
+	fields := []string{
+		"title:" + book.Title,
+		"authors:" + strings.Replace(book.Author, ", ", " & ", -1),
+		"identifiers:isbn:" + book.Identifier,
+		"publisher:" + publisher,
+		"languages:" + book.Language,
+		"tags:" + strings.Join(calibreTags(book.Summary), ","),
+		"comments:" + book.Description,
+	}
+	if !book.Summary.PublicationDate.IsZero() {
+		fields = append(fields, "pubdate:"+book.Summary.PublicationDate.Format("2006-01-02"))
+	}
+	if edition := editionNumber(book.Title); edition > 1 {
+		series := strings.TrimSpace(editionTitleRe.ReplaceAllString(book.Title, ""))
+		fields = append(fields, "series:"+series, "series_index:"+strconv.Itoa(edition))
+	}
+	if book.Cover != "" {
+		fields = append(fields, "cover:"+book.Cover)
+	}
+	return fields
+}
+
+// AddToCalibre adds the files of a build to the Calibre library as the
+// formats of one book, the book of the same ISBN when there is one
+func (c *calibreDB) AddToCalibre(book *Book, files []string) (int, error) {
+	// Calibre names formats after the last extension, a kepub would replace
+	// the epub and directories cannot be added
+	var added []string
+	hasEpub := false
+	for _, file := range files {
+		if strings.HasSuffix(file, ".epub") && !strings.HasSuffix(file, ".kepub.epub") {
+			hasEpub = true
+		}
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.IsDir() || (hasEpub && strings.HasSuffix(file, ".kepub.epub")) {
+			continue
+		}
+		added = append(added, file)
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+
+	id, err := c.findISBN(book.Identifier)
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		out, err := c.run("add", "--duplicates", "--isbn", book.Identifier, "--title", book.Title, added[0])
+		if err != nil {
+			return 0, err
+		}
+		m := calibreAddedRe.FindStringSubmatch(out)
+		if m == nil {
+			return 0, fmt.Errorf("calibredb add: no book id in %q", strings.TrimSpace(out))
+		}
+		id, _ = strconv.Atoi(m[1])
+		added = added[1:]
+	}
+	for _, file := range added {
+		if _, err := c.run("add_format", strconv.Itoa(id), file); err != nil {
+			return id, err
+		}
+	}
+
+	args := []string{"set_metadata", strconv.Itoa(id)}
+	for _, field := range calibreFields(book) {
+		args = append(args, "--field", field)
+	}
+	_, err = c.run(args...)
+	return id, err
+}
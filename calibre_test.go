@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCalibreFields(t *testing.T) {
+	first := &Book{
+		Title:       "Mastering Go",
+		Author:      "Mihalis Tsoukalos",
+		Identifier:  "9781800207974",
+		Language:    "en",
+		Description: "Go in depth.",
+	}
+
+	third := &Book{
+		Title:       "Mastering Go - Third Edition",
+		Author:      "Mihalis Tsoukalos, Jane Doe",
+		Identifier:  "9781801079310",
+		Language:    "en",
+		Description: "Go in depth.",
+		Cover:       "/tmp/cover.jpg",
+	}
+	third.Summary.Publisher = "Packt"
+	third.Summary.PublicationDate = time.Date(2021, 8, 31, 0, 0, 0, 0, time.UTC)
+	third.Summary.Category = "Programming"
+	third.Summary.Meta.Concepts.ConceptName = "Programming"
+	third.Summary.Meta.Tool.ToolName = "Go"
+	third.Summary.Meta.Language.LanguageName = "go"
+
+	tests := []struct {
+		name string
+		book *Book
+		want []string
+	}{
+		{"first edition", first, []string{
+			"title:Mastering Go",
+			"authors:Mihalis Tsoukalos",
+			"identifiers:isbn:9781800207974",
+			"publisher:Packt Publishing",
+			"languages:en",
+			"tags:",
+			"comments:Go in depth.",
+		}},
+		{"later edition", third, []string{
+			"title:Mastering Go - Third Edition",
+			"authors:Mihalis Tsoukalos & Jane Doe",
+			"identifiers:isbn:9781801079310",
+			"publisher:Packt",
+			"languages:en",
+			"tags:Programming,Go",
+			"comments:Go in depth.",
+			"pubdate:2021-08-31",
+			"series:Mastering Go",
+			"series_index:3",
+			"cover:/tmp/cover.jpg",
+		}},
+	}
+	for _, tt := range tests {
+		if got := calibreFields(tt.book); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: calibreFields = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
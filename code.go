@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+// Listing is a code block written out by ExtractCode
+type Listing struct {
+	Path    string
+	Section string
+	Lang    string
+	Caption string
+}
+
+var (
+	captionStartRe = regexp.MustCompile(`(?s).*(<p\b|<div\b|<figcaption\b|</pre>)`)
+	fileNameRe     = regexp.MustCompile(`[\w./-]*\w\.([A-Za-z][A-Za-z0-9]{0,9})\b`)
+)
+
+// extensions for languages whose lexer does not tell a usable file name
+var langExtensions = map[string]string{
+	"console":    "txt",
+	"bash":       "sh",
+	"docker":     "dockerfile",
+	"dockerfile": "dockerfile",
+	"makefile":   "mk",
+	"terraform":  "tf",
+	"hcl":        "tf",
+	"plaintext":  "txt",
+}
+
+// captionBefore returns the text of the paragraph preceding a listing
+func captionBefore(page string) string {
+	loc := captionStartRe.FindStringSubmatchIndex(page)
+	if loc == nil {
+		return ""
+	}
+	text := tagRe.ReplaceAllString(page[loc[2]:], " ")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// captionFileName picks the last file name mentioned in a caption
+func captionFileName(caption string) string {
+	for _, m := range reverse(fileNameRe.FindAllStringSubmatch(caption, -1)) {
+		if lexers.Match(m[0]) != nil {
+			return m[0]
+		}
+	}
+	return ""
+}
+
+func reverse(in [][]string) [][]string {
+	out := make([][]string, len(in))
+	for i := range in {
+		out[len(in)-1-i] = in[i]
+	}
+	return out
+}
+
+func lexerExtension(patterns []string) string {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") && !strings.ContainsAny(pattern[2:], "*?[") {
+			return pattern[2:]
+		}
+	}
+	return ""
+}
+
+// listingExtension infers the file type from the caption, the language hint
+// or, as a last resort, the code itself
+func listingExtension(block CodeBlock, caption string) string {
+	if name := captionFileName(caption); name != "" {
+		return strings.TrimPrefix(filepath.Ext(name), ".")
+	}
+	if ext, ok := langExtensions[block.Lang]; ok {
+		return ext
+	}
+	if block.Lang != "" {
+		if lexer := lexers.Get(block.Lang); lexer != nil {
+			if ext := lexerExtension(lexer.Config().Filenames); ext != "" {
+				return ext
+			}
+		}
+	}
+	if lexer := lexers.Analyse(block.Code); lexer != nil {
+		if ext, ok := langExtensions[strings.ToLower(lexer.Config().Name)]; ok {
+			return ext
+		}
+		if ext := lexerExtension(lexer.Config().Filenames); ext != "" {
+			return ext
+		}
+	}
+	return "txt"
+}
+
+// ExtractCode writes every code listing of the book into outDir as
+// chapterNN/listingMM.ext and returns the listings grouped by chapter
+func ExtractCode(token string, isbn string, outDir string) ([][]Listing, error) {
+	summary, err := GetSummary(isbn)
+	if err != nil {
+		return nil, err
+	}
+	toc, err := GetToc(isbn)
+	if err != nil {
+		return nil, err
+	}
+	listings := make([][]Listing, len(toc.Chapters))
+
+	var failure error
+	// prefaces and appendices carry no listings worth a chapter directory
+	err = WalkToc(token, isbn, TOC{Chapters: toc.Chapters}, func(part string, chapter int, section int, title string, page string) {
+		if failure != nil {
+			return
+		}
+		for _, block := range FindCodeBlocks(page) {
+			caption := captionBefore(page[:block.Start])
+			name := fmt.Sprintf("chapter%02d/listing%02d.%s",
+				chapter+1, len(listings[chapter])+1, listingExtension(block, caption))
+
+			path := filepath.Join(outDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				failure = err
+				return
+			}
+			if err := ioutil.WriteFile(path, []byte(block.Code+"\n"), 0644); err != nil {
+				failure = err
+				return
+			}
+			listings[chapter] = append(listings[chapter], Listing{
+				Path:    name,
+				Section: title,
+				Lang:    block.Lang,
+				Caption: caption,
+			})
+		}
+	})
+	if err != nil {
+		return listings, err
+	}
+	if failure != nil {
+		return listings, failure
+	}
+
+	return listings, writeCodeIndex(outDir, summary, toc, listings)
+}
+
+func writeCodeIndex(outDir string, summary Summary, toc TOC, listings [][]Listing) error {
+	var b strings.Builder
+	b.WriteString("# " + summary.Title + "\n\n")
+	for i, chapter := range toc.Chapters {
+		if len(listings[i]) == 0 {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("## Chapter %d: %s\n\n", i+1, chapter.Title))
+		for _, listing := range listings[i] {
+			b.WriteString(fmt.Sprintf("- [%s](%s) - %s", listing.Path, listing.Path, listing.Section))
+			if listing.Lang != "" {
+				b.WriteString(" (" + listing.Lang + ")")
+			}
+			if listing.Caption != "" {
+				b.WriteString("\n  > " + listing.Caption)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	return ioutil.WriteFile(filepath.Join(outDir, "INDEX.md"), []byte(b.String()), 0644)
+}
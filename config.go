@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// Config is the content of config.toml, keys of a table are stored as
+// "table.key"
+type Config struct {
+	Path   string
+	Values map[string]string
+}
+
+// ConfigKey is a setting config.toml knows about
+type ConfigKey struct {
+	Name        string
+	Default     string
+	Description string
+}
+
+var configKeys = []ConfigKey{
+	{"default_format", "epub", "format written by get when --format is not given"},
+	{"output_dir", ".", "directory books are written to"},
+	{"name_template", defaultNameTemplate, "file name of books, {title} {isbn} {author} {year} {edition}"},
+	{"concurrency", "4", "sections downloaded in parallel"},
+	{"theme", "color", "code highlighting: color, eink or none"},
+	{"images", "original", "image preset: kindle, tablet or original"},
+	{"converter_path", "", "ebook-convert binary or Calibre directory"},
+	{"calibre_library", "", "Calibre library every build is added to"},
+	{"proxy", "", "proxy for all requests, http:// https:// or socks5://"},
+	{"ca_bundle", "", "extra PEM certificates to trust, separated like $PATH"},
+	{"library", "", "catalog of built books, $XDG_DATA_HOME/packt/library.db when empty"},
+	{"deterministic", "false", "byte for byte reproducible builds dated from the publication date"},
+	{"serve.listen", ":8080", "address the OPDS catalog of serve listens on"},
+	{"serve.title", "Packt library", "name of the OPDS catalog"},
+	{"daemon.listen", "127.0.0.1:8081", "address the job API of daemon listens on"},
+	{"daemon.jobs", "2", "jobs daemon runs at a time"},
+	{"daemon.token", "", "bearer token the job API asks for, none when empty"},
+	{"auth.token", "", "access token, written by login"},
+	{"auth.refresh", "", "refresh token, written by login"},
+}
+
+// flags that fall back to a setting when they are not on the command line
+var flagSettings = map[string]string{
+	"output-dir":      "output_dir",
+	"name-template":   "name_template",
+	"concurrency":     "concurrency",
+	"highlight":       "theme",
+	"images":          "images",
+	"calibre-path":    "converter_path",
+	"proxy":           "proxy",
+	"calibre-library": "calibre_library",
+	"ca-bundle":       "ca_bundle",
+	"deterministic":   "deterministic",
+	"library":         "library",
+	"listen":          "serve.listen",
+	"title":           "serve.title",
+	"jobs":            "daemon.jobs",
+	"api-token":       "daemon.token",
+}
+
+var config = &Config{Values: map[string]string{}}
+
+var (
+	tomlTableRe = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+)\s*\]$`)
+	tomlKeyRe   = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	tomlBareRe  = regexp.MustCompile(`^(true|false|[+-]?[0-9][0-9_]*(\.[0-9]+)?)$`)
+)
+
+// configDir is $XDG_CONFIG_HOME/packt, or the platform config directory
+func configDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "packt")
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "packt")
+	}
+	return filepath.Join(usr.HomeDir, ".config", "packt")
+}
+
+// setting looks a key up in the PACKT_* environment, then in config.toml
+func setting(key string, def string) string {
+	env := "PACKT_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+	if value, ok := os.LookupEnv(env); ok {
+		return value
+	}
+	if value, ok := config.Values[key]; ok {
+		return value
+	}
+	return def
+}
+
+// settingSource tells where the value of a key comes from
+func settingSource(key string) string {
+	env := "PACKT_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+	if _, ok := os.LookupEnv(env); ok {
+		return "env " + env
+	}
+	if _, ok := config.Values[key]; ok {
+		return "file"
+	}
+	return "default"
+}
+
+func findConfigKey(name string) (ConfigKey, bool) {
+	for _, key := range configKeys {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return ConfigKey{}, false
+}
+
+// parseTomlValue reads a string, integer or boolean value, comments after
+// the value are dropped
+func parseTomlValue(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		var b strings.Builder
+		for i := 1; i < len(raw); i++ {
+			c := raw[i]
+			switch {
+			case c == '"':
+				if rest := strings.TrimSpace(raw[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected %q after string", rest)
+				}
+				return b.String(), nil
+			case c == '\\' && i+1 < len(raw):
+				i++
+				switch raw[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case '"', '\\':
+					b.WriteByte(raw[i])
+				default:
+					return "", fmt.Errorf("unknown escape \\%c", raw[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated string")
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return raw[1 : end+1], nil
+	}
+	if hash := strings.Index(raw, "#"); hash >= 0 {
+		raw = strings.TrimSpace(raw[:hash])
+	}
+	if !tomlBareRe.MatchString(raw) {
+		return "", fmt.Errorf("invalid value %q, quote strings", raw)
+	}
+	return strings.Replace(raw, "_", "", -1), nil
+}
+
+// ParseConfig reads the subset of TOML the config file uses: tables, and
+// keys with string, integer and boolean values
+func ParseConfig(data string) (map[string]string, error) {
+	values := map[string]string{}
+	table := ""
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := tomlTableRe.FindStringSubmatch(line); m != nil {
+			table = m[1] + "."
+			continue
+		}
+		m := tomlKeyRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		value, err := parseTomlValue(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		values[table+m[1]] = value
+	}
+	return values, nil
+}
+
+// sameKind tells if two values are both integers or both booleans
+func sameKind(a string, b string) bool {
+	isBool := func(v string) bool { return v == "true" || v == "false" }
+	if isBool(a) && isBool(b) {
+		return true
+	}
+	_, errA := strconv.Atoi(a)
+	_, errB := strconv.Atoi(b)
+	return errA == nil && errB == nil
+}
+
+// tomlValue formats a setting, numbers and booleans are only left bare for
+// the keys whose default is one, "1.10" stays a string everywhere else
+func tomlValue(key string, value string) string {
+	if k, ok := findConfigKey(key); ok && sameKind(k.Default, value) {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(value) + `"`
+}
+
+// String formats the config as TOML, top level keys first
+func (c *Config) String() string {
+	tables := map[string][]string{}
+	for key := range c.Values {
+		table := ""
+		if dot := strings.LastIndex(key, "."); dot >= 0 {
+			table = key[:dot]
+		}
+		tables[table] = append(tables[table], key)
+	}
+	var names []string
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, table := range names {
+		if table != "" {
+			b.WriteString("\n[" + table + "]\n")
+		}
+		keys := tables[table]
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := strings.TrimPrefix(key, table+".")
+			b.WriteString(name + " = " + tomlValue(key, c.Values[key]) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// Save writes the config, it holds the tokens so only the user can read it.
+// It is written through a temporary file so a crash cannot leave half of it,
+// a symlinked config keeps its link
+func (c *Config) Save() error {
+	file := c.Path
+	if target, err := filepath.EvalSymlinks(file); err == nil {
+		file = target
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(c.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Set checks a value before storing it
+func (c *Config) Set(name string, value string) error {
+	if _, ok := findConfigKey(name); !ok {
+		var names []string
+		for _, key := range configKeys {
+			names = append(names, key.Name)
+		}
+		return fmt.Errorf("unknown key %q, use one of %s", name, strings.Join(names, ", "))
+	}
+	switch name {
+	case "concurrency":
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			return fmt.Errorf("concurrency must be a positive number")
+		}
+	case "theme":
+		if value != "color" && value != "eink" && value != "none" {
+			return fmt.Errorf("theme must be color, eink or none")
+		}
+	case "deterministic":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("deterministic must be true or false")
+		}
+	case "images":
+		if _, ok := imageProfiles[value]; !ok {
+			return fmt.Errorf("images must be kindle, tablet or original")
+		}
+	case "default_format":
+		if _, err := parseFormats(value); err != nil {
+			return err
+		}
+	case "name_template":
+		if _, err := expandTemplate(value, map[string]string{
+			"title": "", "isbn": "", "author": "", "year": "", "edition": "",
+		}); err != nil {
+			return err
+		}
+	}
+	if value == "" {
+		delete(c.Values, name)
+		return nil
+	}
+	c.Values[name] = value
+	return nil
+}
+
+// migrateLegacyConfig moves the tokens of ~/.packt_config into config.toml
+func migrateLegacyConfig() error {
+	legacy := filepath.Join(usr.HomeDir, ".packt_config")
+	if _, err := os.Stat(legacy); err != nil {
+		return nil
+	}
+	values, err := godotenv.Read(legacy)
+	if err != nil {
+		return err
+	}
+	for old, key := range map[string]string{"TOKEN": "auth.token", "REFRESH": "auth.refresh", "CALIBRE_PATH": "converter_path"} {
+		if _, ok := config.Values[key]; !ok && values[old] != "" {
+			config.Values[key] = values[old]
+		}
+	}
+	if err := config.Save(); err != nil {
+		return err
+	}
+	fmt.Println("Settings moved from " + legacy + " to " + config.Path)
+	return os.Rename(legacy, legacy+".bak")
+}
+
+// loadConfig reads config.toml, migrating the old settings file first
+func loadConfig() error {
+	config.Path = filepath.Join(configDir(), "config.toml")
+	data, err := ioutil.ReadFile(config.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		values, err := ParseConfig(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", config.Path, err)
+		}
+		config.Values = values
+	}
+	return migrateLegacyConfig()
+}
+
+func editConfig() error {
+	if _, err := os.Stat(config.Path); os.IsNotExist(err) {
+		if err := config.Save(); err != nil {
+			return err
+		}
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+	args, err := splitArgs(editor)
+	if err != nil || len(args) == 0 {
+		return fmt.Errorf("invalid editor %q", editor)
+	}
+	cmd := exec.Command(args[0], append(args[1:], config.Path)...) // #nosec G204 -- the editor is picked by the user
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(config.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseConfig(string(data)); err != nil {
+		return fmt.Errorf("%s: %v", config.Path, err)
+	}
+	return nil
+}
+
+// ConfigCommand runs packt config get|set|list|edit
+func ConfigCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: config get <key> | set <key> <value> | list | edit")
+	}
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return errors.New("usage: config get <key>")
+		}
+		key, ok := findConfigKey(args[1])
+		if !ok {
+			return fmt.Errorf("unknown key %q", args[1])
+		}
+		fmt.Println(setting(key.Name, key.Default))
+	case "set":
+		if len(args) != 3 {
+			return errors.New("usage: config set <key> <value>")
+		}
+		if err := config.Set(args[1], args[2]); err != nil {
+			return err
+		}
+		return config.Save()
+	case "list":
+		for _, key := range configKeys {
+			value := setting(key.Name, key.Default)
+			if strings.HasPrefix(key.Name, "auth.") && len(value) > 8 {
+				value = value[:4] + "..." + value[len(value)-4:]
+			}
+			fmt.Printf("%-15s = %-20q # %s (%s)\n", key.Name, value, key.Description, settingSource(key.Name))
+		}
+		fmt.Println("\nFile: " + config.Path)
+	case "edit":
+		return editConfig()
+	default:
+		return fmt.Errorf("unknown config command %q, use get, set, list or edit", args[0])
+	}
+	return nil
+}
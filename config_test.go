@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "# nothing set\n\n", map[string]string{}, false},
+		{"basic string", `output_dir = "~/Books"`, map[string]string{"output_dir": "~/Books"}, false},
+		{"escapes", `name_template = "{title}\t\"{year}\"\\"`, map[string]string{"name_template": "{title}\t\"{year}\"\\"}, false},
+		{"literal string", `converter_path = 'C:\Program Files\Calibre2'`, map[string]string{"converter_path": `C:\Program Files\Calibre2`}, false},
+		{"bare values", "concurrency = 1_0 # workers\ndeterministic = true", map[string]string{"concurrency": "10", "deterministic": "true"}, false},
+		{"comment after string", `theme = "eink" # e-readers`, map[string]string{"theme": "eink"}, false},
+		{"tables", "proxy = \"\"\n[serve]\nlisten = \":8080\"\n[daemon]\njobs = 2", map[string]string{"proxy": "", "serve.listen": ":8080", "daemon.jobs": "2"}, false},
+		{"bare string", "theme = eink", nil, true},
+		{"unterminated", `theme = "eink`, nil, true},
+		{"unknown escape", `theme = "\e"`, nil, true},
+		{"trailing text", `theme = "eink" none`, nil, true},
+		{"no value", "theme", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseConfig(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTomlValue(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{"concurrency", "8", "8"},
+		{"daemon.jobs", "2", "2"},
+		{"deterministic", "true", "true"},
+		{"concurrency", "eight", `"eight"`},
+		{"deterministic", "1", `"1"`},
+		{"output_dir", "1.10", `"1.10"`},
+		{"serve.title", "true", `"true"`},
+		{"auth.token", "12345", `"12345"`},
+		{"name_template", "{title}\t\"{year}\"\\", `"{title}\t\"{year}\"\\"`},
+		{"unknown", "3", `"3"`},
+	}
+	for _, tt := range tests {
+		if got := tomlValue(tt.key, tt.value); got != tt.want {
+			t.Errorf("tomlValue(%q, %q) = %s, want %s", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	values := map[string]string{
+		"output_dir":    "1.10",
+		"name_template": "{author} - {title}\n\"{year}\"",
+		"concurrency":   "8",
+		"deterministic": "false",
+		"proxy":         "",
+		"ca_bundle":     `C:\certs\corp.pem`,
+		"serve.title":   "true",
+		"serve.listen":  ":8080",
+		"daemon.jobs":   "2",
+		"daemon.token":  "0042",
+	}
+	c := &Config{Values: values}
+	got, err := ParseConfig(c.String())
+	if err != nil {
+		t.Fatalf("ParseConfig(%q): %v", c.String(), err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("round trip of\n%s\ngot %v, want %v", c.String(), got, values)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const (
+	mathNS = "http://www.w3.org/1998/Math/MathML"
+	svgNS  = "http://www.w3.org/2000/svg"
+
+	// tables with more columns than this do not fit a reader screen
+	wideTableColumns = 5
+)
+
+// contentCSS styles the markup prepareContent and SimplifyBook add
+const contentCSS = `
+.table-wrap { overflow-x: auto; max-width: 100%; }
+.table-wrap.wide-table table { font-size: 0.8em; }
+.table-reflow .table-row { margin: 0.5em 0; padding-bottom: 0.5em; border-bottom: 1px solid #ccc; }
+div.math-block { text-align: center; margin: 0.5em 0; }
+`
+
+var (
+	mathTagRe   = regexp.MustCompile(`<math\b[^>]*>`)
+	svgTagRe    = regexp.MustCompile(`<svg\b[^>]*>`)
+	svgRe       = regexp.MustCompile(`(?s)<svg\b.*?</svg>`)
+	svgTitleRe  = regexp.MustCompile(`(?s)<title\b[^>]*>(.*?)</title>`)
+	xmlnsRe     = regexp.MustCompile(`\sxmlns="`)
+	mathRe      = regexp.MustCompile(`(?s)<math\b[^>]*>.*?</math>`)
+	displayRe   = regexp.MustCompile(`\sdisplay="block"`)
+	mathStyleRe = regexp.MustCompile(`height: ([\d.]+)em; vertical-align: -([\d.]+)em`)
+	tableRe     = regexp.MustCompile(`(?s)<table\b.*?</table>`)
+	tableRowRe  = regexp.MustCompile(`(?s)<tr\b.*?</tr>`)
+	cellRe      = regexp.MustCompile(`(?s)<t([hd])\b[^>]*>(.*?)</t[hd]>`)
+	opfItemRe   = regexp.MustCompile(`<item\b[^>]*>`)
+	opfAttrRe   = regexp.MustCompile(`\s(href|media-type|properties)="([^"]*)"`)
+)
+
+// withNamespace adds the default namespace to root elements that lost it,
+// MathML and SVG are not rendered without
+func withNamespace(re *regexp.Regexp, body string, name string, ns string) string {
+	return re.ReplaceAllStringFunc(body, func(tag string) string {
+		if xmlnsRe.MatchString(tag) {
+			return tag
+		}
+		return "<" + name + ` xmlns="` + ns + `"` + tag[len(name)+1:]
+	})
+}
+
+func tableColumns(table string) int {
+	row := tableRowRe.FindString(table)
+	return len(cellRe.FindAllString(row, -1))
+}
+
+// prepareContent keeps MathML and SVG renderable and makes tables scroll
+// instead of overflowing the page
+func prepareContent(body string) string {
+	body = withNamespace(mathTagRe, body, "math", mathNS)
+	body = withNamespace(svgTagRe, body, "svg", svgNS)
+	return tableRe.ReplaceAllStringFunc(body, func(table string) string {
+		class := "table-wrap"
+		if tableColumns(table) > wideTableColumns {
+			class += " wide-table"
+		}
+		return `<div class="` + class + `">` + table + `</div>`
+	})
+}
+
+// reflowTable turns a wide table into one block per row, each cell labelled
+// with its column header
+func reflowTable(table string) string {
+	rows := tableRowRe.FindAllString(table, -1)
+	var header []string
+	var b strings.Builder
+	b.WriteString(`<div class="table-reflow">`)
+	for i, row := range rows {
+		cells := cellRe.FindAllStringSubmatch(row, -1)
+		if i == 0 && len(cells) > 0 && cells[0][1] == "h" {
+			for _, cell := range cells {
+				header = append(header, strings.TrimSpace(tagRe.ReplaceAllString(cell[2], "")))
+			}
+			continue
+		}
+		b.WriteString(`<p class="table-row">`)
+		for j, cell := range cells {
+			if j > 0 {
+				b.WriteString("<br/>")
+			}
+			if j < len(header) && header[j] != "" {
+				b.WriteString("<b>" + header[j] + ":</b> ")
+			}
+			b.WriteString(strings.TrimSpace(cell[2]))
+		}
+		b.WriteString("</p>")
+	}
+	b.WriteString("</div>")
+	return b.String()
+}
+
+// SimplifyBook returns a copy of the book for formats without MathML, SVG
+// and scrolling, format names it in the warning: formulas and SVG images
+// are rendered to PNG and wide tables are reflowed. What cannot be rendered
+// is replaced by its text or description
+func SimplifyBook(book *Book, format string) *Book {
+	simple := *book
+	simple.Sections = make([]Section, len(book.Sections))
+	simple.Assets = nil
+	svgs := map[string]string{}
+	for _, asset := range book.Assets {
+		if strings.ToLower(path.Ext(asset.Name)) == ".svg" {
+			svgs[asset.Name] = asset.Path
+			continue
+		}
+		simple.Assets = append(simple.Assets, asset)
+	}
+
+	// rendered images are named after their content, the same formula is
+	// only stored once
+	added := map[string]bool{}
+	addImage := func(prefix string, data []byte) (string, error) {
+		sum := sha256.Sum256(data)
+		name := prefix + hex.EncodeToString(sum[:6]) + ".png"
+		if !added[name] {
+			file := tempPath(name)
+			if err := ioutil.WriteFile(file, data, 0644); err != nil {
+				return "", err
+			}
+			added[name] = true
+			simple.Assets = append(simple.Assets, Asset{Name: name, Path: file})
+		}
+		return name, nil
+	}
+
+	var left []MissingImage
+	for i, section := range book.Sections {
+		body := mathRe.ReplaceAllStringFunc(section.Body, func(math string) string {
+			display := displayRe.MatchString(mathTagRe.FindString(math))
+			out, err := mathImage(math, display, addImage)
+			if err != nil {
+				text := MathText(math)
+				left = append(left, MissingImage{Section: section.Title, URL: "formula " + text, Err: err})
+				out = `<i class="math">` + xhtmlEscaper.Replace(text) + `</i>`
+			}
+			if display {
+				return `<div class="math-block">` + out + `</div>`
+			}
+			return out
+		})
+		body = svgRe.ReplaceAllStringFunc(body, func(svg string) string {
+			title := "diagram"
+			if m := svgTitleRe.FindStringSubmatch(svg); m != nil {
+				title = strings.TrimSpace(tagRe.ReplaceAllString(m[1], ""))
+			}
+			data, err := RenderSVG([]byte(svg))
+			name := ""
+			if err == nil {
+				name, err = addImage("svg-", data)
+			}
+			if err != nil {
+				left = append(left, MissingImage{Section: section.Title, URL: "inline <svg>", Err: err})
+				return `<p><i>[Image: ` + title + `]</i></p>`
+			}
+			return `<img src="../images/` + name + `" alt="` + attrEscaper.Replace(html.UnescapeString(title)) + `"/>`
+		})
+		body = imgTagRe.ReplaceAllStringFunc(body, func(img string) string {
+			src := srcRe.FindStringSubmatch(img)
+			if src == nil || strings.ToLower(path.Ext(src[1])) != ".svg" {
+				return img
+			}
+			name, err := svgImage(svgs, path.Base(src[1]), addImage)
+			if err != nil {
+				left = append(left, MissingImage{Section: section.Title, URL: path.Base(src[1]), Err: err})
+				alt := path.Base(src[1])
+				if m := altRe.FindStringSubmatch(img); m != nil && m[1] != "" {
+					alt = m[1]
+				}
+				return `<i>[Image: ` + alt + `]</i>`
+			}
+			return strings.Replace(img, src[0], ` src="../images/`+name+`"`, 1)
+		})
+		body = tableRe.ReplaceAllStringFunc(body, func(table string) string {
+			if tableColumns(table) > wideTableColumns {
+				return reflowTable(table)
+			}
+			return table
+		})
+		section.Body = body
+		simple.Sections[i] = section
+	}
+
+	if len(left) > 0 {
+		color.Yellow(fmt.Sprintf("%d formulas or SVG images could not be rendered for %s and were replaced by their text, the EPUB keeps them:", len(left), format))
+		for _, missing := range left {
+			fmt.Printf("  %s: %s: %v\n", missing.Section, missing.URL, missing.Err)
+		}
+	}
+	return &simple
+}
+
+// mathImage renders a formula and returns the img element showing it, sized
+// in em and moved down by its depth so it sits on the baseline of the text
+func mathImage(math string, display bool, addImage func(string, []byte) (string, error)) (string, error) {
+	img, err := RenderMath(math)
+	if err != nil {
+		return "", err
+	}
+	name, err := addImage("math-", img.PNG)
+	if err != nil {
+		return "", err
+	}
+	class := "math"
+	if display {
+		class += " display"
+	}
+	return fmt.Sprintf(`<img class="%s" src="../images/%s" alt="%s" style="height: %.2fem; vertical-align: -%.2fem"/>`,
+		class, name, attrEscaper.Replace(MathText(math)), img.Height, img.Depth), nil
+}
+
+// svgImage renders an SVG asset of the book to PNG
+func svgImage(svgs map[string]string, name string, addImage func(string, []byte) (string, error)) (string, error) {
+	file, ok := svgs[name]
+	if !ok {
+		return "", fmt.Errorf("%s was not downloaded", name)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if data, err = RenderSVG(data); err != nil {
+		return "", err
+	}
+	return addImage("svg-", data)
+}
+
+// fixEpubPackage copies an EPUB declaring SVG images with their media type
+// and marking the content documents with MathML or SVG in the package
+// document, EPUB3 readers only render them with those properties
+func fixEpubPackage(src string, dst string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	properties := map[string][]string{}
+	for _, f := range r.File {
+		if !isContentDocument(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			r.Close()
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			r.Close()
+			return err
+		}
+		if mathTagRe.Match(data) {
+			properties[f.Name] = append(properties[f.Name], "mathml")
+		}
+		if svgTagRe.Match(data) {
+			properties[f.Name] = append(properties[f.Name], "svg")
+		}
+	}
+	r.Close()
+
+	return rewriteZip(src, dst, func(name string, data []byte) []byte {
+		if path.Ext(name) != ".opf" {
+			return data
+		}
+		dir := path.Dir(name)
+		return opfItemRe.ReplaceAllFunc(data, func(item []byte) []byte {
+			attrs := map[string]string{}
+			for _, m := range opfAttrRe.FindAllSubmatch(item, -1) {
+				attrs[string(m[1])] = string(m[2])
+			}
+			href := attrs["href"]
+			out := string(item)
+			if strings.ToLower(path.Ext(href)) == ".svg" && attrs["media-type"] != "image/svg+xml" {
+				out = strings.Replace(out, `media-type="`+attrs["media-type"]+`"`, `media-type="image/svg+xml"`, 1)
+			}
+			add := properties[path.Join(dir, href)]
+			if len(add) == 0 {
+				return []byte(out)
+			}
+			if current, ok := attrs["properties"]; ok {
+				merged := strings.Fields(current)
+				for _, p := range add {
+					if !strings.Contains(" "+current+" ", " "+p+" ") {
+						merged = append(merged, p)
+					}
+				}
+				return []byte(strings.Replace(out, `properties="`+current+`"`, `properties="`+strings.Join(merged, " ")+`"`, 1))
+			}
+			return []byte(strings.Replace(out, "<item", `<item properties="`+strings.Join(add, " ")+`"`, 1))
+		})
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterWriter("mobi", &mobiWriter{})
+}
+
+// Converter runs Calibre's ebook-convert on a generated EPUB
+type Converter struct {
+	Path    string
+	Profile string
+	Args    []string
+}
+
+// places Calibre installs its tools to when they are not on $PATH
+var calibreLocations = []string{
+	"/Applications/calibre.app/Contents/MacOS",
+	"/usr/bin",
+	"/usr/local/bin",
+	"/opt/calibre",
+	`C:\Program Files\Calibre2`,
+	`C:\Program Files (x86)\Calibre2`,
+}
+
+// findCalibreTool looks for a Calibre command like ebook-convert in
+// --calibre-path, the CALIBRE_PATH setting, $PATH and the default install
+// locations, in that order. A configured file is used for ebook-convert
+// only, the other tools are looked up next to it
+func findCalibreTool(name string) (string, error) {
+	for _, configured := range []string{flagValue("calibre-path", ""), os.Getenv("CALIBRE_PATH")} {
+		if configured == "" {
+			continue
+		}
+		if info, err := os.Stat(configured); err == nil && info.IsDir() {
+			configured = filepath.Join(configured, name)
+		} else if name != "ebook-convert" {
+			configured = filepath.Join(filepath.Dir(configured), name)
+		}
+		path, err := exec.LookPath(configured)
+		if err != nil {
+			return "", fmt.Errorf("%s not usable at %s: %v", name, configured, err)
+		}
+		return path, nil
+	}
+
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	for _, dir := range calibreLocations {
+		for _, path := range []string{filepath.Join(dir, name), filepath.Join(dir, name+".exe")} {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s not found, install Calibre or set --calibre-path", name)
+}
+
+// FindConverter looks for ebook-convert
+func FindConverter() (string, error) {
+	return findCalibreTool("ebook-convert")
+}
+
+// NewConverter builds a converter from the command line flags
+func NewConverter() (*Converter, error) {
+	path, err := FindConverter()
+	if err != nil {
+		return nil, err
+	}
+	args, err := splitArgs(flagValue("convert-args", ""))
+	if err != nil {
+		return nil, err
+	}
+	return &Converter{
+		Path:    path,
+		Profile: flagValue("output-profile", ""),
+		Args:    args,
+	}, nil
+}
+
+// Convert turns src into dst, the output format follows the dst extension
+func (c *Converter) Convert(src string, dst string) error {
+	args := []string{src, dst}
+	if c.Profile != "" {
+		args = append(args, "--output-profile", c.Profile)
+	}
+	args = append(args, c.Args...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.Path, args...) // #nosec G204 -- the converter is picked by the user
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", filepath.Base(c.Path), strings.Join(args, " "), err, lastLines(stderr.String(), 20))
+	}
+	if _, err := os.Stat(dst); err != nil {
+		return fmt.Errorf("%s did not produce %s\n%s", filepath.Base(c.Path), dst, lastLines(stderr.String(), 20))
+	}
+	return nil
+}
+
+// mobiWriter builds an EPUB and has Calibre convert it
+type mobiWriter struct {
+	converter *Converter
+}
+
+func (w *mobiWriter) Prepare() error {
+	converter, err := NewConverter()
+	w.converter = converter
+	return err
+}
+
+func (w *mobiWriter) Extension() string {
+	return ".mobi"
+}
+
+func (w *mobiWriter) Write(book *Book, path string) error {
+	if w.converter == nil {
+		if err := w.Prepare(); err != nil {
+			return err
+		}
+	}
+	// built aside so an epub written in the same run is not replaced
+	epubPath := tempPath(book.Identifier + ".mobi.epub")
+	if err := WriteEpub(book, epubPath); err != nil {
+		return err
+	}
+	if err := w.converter.Convert(epubPath, path); err != nil {
+		kept := strings.TrimSuffix(path, ".mobi") + ".epub"
+		if _, statErr := os.Stat(kept); os.IsNotExist(statErr) && copyFile(epubPath, kept) == nil {
+			return fmt.Errorf("%v\nConversion failed, the EPUB is kept at %s", err, kept)
+		}
+		return err
+	}
+	return nil
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// splitArgs splits a command line the way a shell would, honouring quotes
+// and backslash escapes
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	quote := rune(0)
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	imagecolor "image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// size of generated covers, the ratio of the Packt covers
+const (
+	coverWidth  = 1600
+	coverHeight = 1974
+)
+
+var (
+	coverSizeRe = regexp.MustCompile(`/cover(/[a-z]+)?$`)
+
+	coverBackground = imagecolor.RGBA{R: 0x12, G: 0x1b, B: 0x29, A: 0xff}
+	coverAccent     = imagecolor.RGBA{R: 0xec, G: 0x66, B: 0x11, A: 0xff}
+	coverMuted      = imagecolor.RGBA{R: 0xc8, G: 0xcd, B: 0xd4, A: 0xff}
+)
+
+// coverVariants lists the sizes the CDN may have for a cover, the one of
+// the summary last
+func coverVariants(cover string) []string {
+	if cover == "" {
+		return nil
+	}
+	if !coverSizeRe.MatchString(cover) {
+		return []string{cover}
+	}
+	base := coverSizeRe.ReplaceAllString(cover, "/cover")
+	variants := []string{base, base + "/large", base + "/big"}
+	for _, variant := range variants {
+		if variant == cover {
+			return variants
+		}
+	}
+	return append(variants, cover)
+}
+
+// imageArea decodes the header of an image file, it fails for anything that
+// is not an image
+func imageArea(path string) (int, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, "", err
+	}
+	return cfg.Width * cfg.Height, format, nil
+}
+
+// downloadCover fetches the variants of the cover and keeps the largest one
+func downloadCover(cover string) (string, error) {
+	best, bestArea := "", 0
+	var lastErr error
+	for i, variant := range coverVariants(cover) {
+		path := tempPath("cover-" + strconv.Itoa(i))
+		if err := grabFile(path, variant); err != nil {
+			lastErr = err
+			continue
+		}
+		area, _, err := imageArea(path)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", variant, err)
+			os.Remove(path)
+			continue
+		}
+		if area > bestArea {
+			if best != "" {
+				os.Remove(best)
+			}
+			best, bestArea = path, area
+		} else {
+			os.Remove(path)
+		}
+	}
+	if best == "" {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("the book has no cover")
+		}
+		return "", lastErr
+	}
+	_, format, _ := imageArea(best)
+	named := tempPath("cover." + strings.Replace(format, "jpeg", "jpg", 1))
+	return named, os.Rename(best, named)
+}
+
+// wrapText breaks text into lines no wider than width for a font face
+func wrapText(face font.Face, text string, width int) []string {
+	drawer := &font.Drawer{Face: face}
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		next := word
+		if line != "" {
+			next = line + " " + word
+		}
+		if line != "" && drawer.MeasureString(next).Ceil() > width {
+			lines = append(lines, line)
+			next = word
+		}
+		line = next
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func coverFace(ttf []byte, size float64) (font.Face, error) {
+	parsed, err := opentype.Parse(ttf)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// drawLines writes lines from the top y, returns where the text ends
+func drawLines(img draw.Image, face font.Face, c imagecolor.Color, lines []string, x int, y int) int {
+	metrics := face.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil() * 6 / 5
+	drawer := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+	for _, line := range lines {
+		drawer.Dot = fixed.Point26_6{X: fixed.I(x), Y: fixed.I(y) + metrics.Ascent}
+		drawer.DrawString(line)
+		y += lineHeight
+	}
+	return y
+}
+
+// GenerateCover draws a cover with the title and authors of a book in the
+// layout of the Packt covers and writes it as a JPEG
+func GenerateCover(book *Book, path string) error {
+	titleFace, err := coverFace(gobold.TTF, 120)
+	if err != nil {
+		return err
+	}
+	defer titleFace.Close()
+	textFace, err := coverFace(goregular.TTF, 56)
+	if err != nil {
+		return err
+	}
+	defer textFace.Close()
+
+	const margin = 140
+	img := image.NewRGBA(image.Rect(0, 0, coverWidth, coverHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(coverBackground), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, coverWidth, 60), image.NewUniform(coverAccent), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(margin, 420, margin+240, 440), image.NewUniform(coverAccent), image.Point{}, draw.Src)
+
+	y := drawLines(img, titleFace, image.White, wrapText(titleFace, book.Title, coverWidth-2*margin), margin, 500)
+	if book.Summary.OneLiner != "" {
+		y = drawLines(img, textFace, coverMuted, wrapText(textFace, book.Summary.OneLiner, coverWidth-2*margin), margin, y+60)
+	}
+	drawLines(img, textFace, image.White, wrapText(textFace, book.Author, coverWidth-2*margin), margin, coverHeight-420)
+	drawLines(img, titleFace, coverAccent, []string{"<packt>"}, margin, coverHeight-260)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 90}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// FetchCover sets the cover of a book: the --cover file, else the largest
+// cover on the CDN, else a generated one. A book without a cover is not an
+// error, early access and video products often have none, a --cover that
+// cannot be used is
+func FetchCover(book *Book) error {
+	if custom := flagValue("cover", ""); custom != "" {
+		if _, _, err := imageArea(custom); err != nil {
+			return fmt.Errorf("--cover %s: %v", custom, err)
+		}
+		book.Cover = custom
+		return nil
+	}
+
+	path, err := downloadCover(book.Summary.CoverImage)
+	if err == nil {
+		book.Cover = path
+		return nil
+	}
+	color.Yellow("Cover not downloaded, generating one: " + err.Error())
+
+	path = tempPath("cover.jpg")
+	if err := GenerateCover(book, path); err != nil {
+		color.Yellow("Cover not generated: " + err.Error())
+		return nil
+	}
+	book.Cover = path
+	return nil
+}
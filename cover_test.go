@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoverVariants(t *testing.T) {
+	base := "https://static.packt-cdn.com/products/9781800207974/cover"
+	tests := []struct {
+		cover string
+		want  []string
+	}{
+		{"", nil},
+		{"https://example.com/covers/9781800207974.png", []string{"https://example.com/covers/9781800207974.png"}},
+		{base, []string{base, base + "/large", base + "/big"}},
+		{base + "/large", []string{base, base + "/large", base + "/big"}},
+		{base + "/smaller", []string{base, base + "/large", base + "/big", base + "/smaller"}},
+	}
+	for _, tt := range tests {
+		if got := coverVariants(tt.cover); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("coverVariants(%q) = %q, want %q", tt.cover, got, tt.want)
+		}
+	}
+}
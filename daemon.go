@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+
+	// jobStopTimeout is how long a stopping daemon waits for its jobs to
+	// clean up before killing them
+	jobStopTimeout = 10 * time.Second
+)
+
+var (
+	jobIsbnRe    = regexp.MustCompile(`^[0-9][0-9Xx-]{8,16}$`)
+	jobOutputRe  = regexp.MustCompile(`(?m)^Output : (.+)$`)
+	jobSkippedRe = regexp.MustCompile(`(?m)^Skipped : (.+?) (?:is up to date|already exists)`)
+)
+
+// options a job may set, the others come from the daemon so clients cannot
+// pick where files go or which programs run
+var jobOptions = map[string]bool{
+	"name-template": true,
+	"on-conflict":   true,
+	"images":        true,
+	"highlight":     true,
+	"line-numbers":  true,
+	"force":         true,
+	"deterministic": true,
+}
+
+// flags of the daemon itself, not passed on to the jobs
+var daemonFlags = map[string]bool{
+	"listen":    true,
+	"jobs":      true,
+	"api-token": true,
+}
+
+// Job is a book to download, run as packt get in a process of its own
+type Job struct {
+	ID        string            `json:"id"`
+	ISBN      string            `json:"isbn"`
+	Formats   []string          `json:"formats"`
+	Options   map[string]string `json:"options,omitempty"`
+	State     string            `json:"state"`
+	Created   time.Time         `json:"created"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Error     string            `json:"error,omitempty"`
+	Artifacts []string          `json:"artifacts,omitempty"`
+}
+
+// args is the command line of the job, the options of the daemon come last
+// and win
+func (j *Job) args() []string {
+	args := []string{"get", j.ISBN, "--format", strings.Join(j.Formats, ",")}
+	add := func(options map[string]string) {
+		var names []string
+		for name := range options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch {
+			case !boolFlags[name]:
+				args = append(args, "--"+name, options[name])
+			case options[name] != "false":
+				args = append(args, "--"+name)
+			}
+		}
+	}
+	add(j.Options)
+	inherited := map[string]string{}
+	for name, value := range flags {
+		if !daemonFlags[name] {
+			inherited[name] = value
+		}
+	}
+	add(inherited)
+	return args
+}
+
+// validate checks a job sent to the API before it is queued
+func (j *Job) validate() error {
+	if !jobIsbnRe.MatchString(j.ISBN) {
+		return fmt.Errorf("invalid ISBN %q", j.ISBN)
+	}
+	if len(j.Formats) == 0 {
+		j.Formats = []string{setting("default_format", "epub")}
+	}
+	formats, err := parseFormats(strings.Join(j.Formats, ","))
+	if err != nil {
+		return err
+	}
+	j.Formats = formats
+	for name := range j.Options {
+		if !jobOptions[name] {
+			return fmt.Errorf("option %q cannot be set by a job", name)
+		}
+	}
+	return nil
+}
+
+// jobQueue runs the jobs, its state is written to jobs.json after every
+// change so a restarted daemon carries on
+type jobQueue struct {
+	mu       sync.Mutex
+	path     string
+	logs     string
+	exe      string
+	limit    int
+	running  map[string]*exec.Cmd
+	stopping bool
+	wg       sync.WaitGroup
+
+	NextID int    `json:"nextId"`
+	Jobs   []*Job `json:"jobs"`
+}
+
+func openJobQueue(dir string, limit int) (*jobQueue, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	q := &jobQueue{
+		path:    filepath.Join(dir, "jobs.json"),
+		logs:    filepath.Join(dir, "jobs"),
+		exe:     exe,
+		limit:   limit,
+		running: map[string]*exec.Cmd{},
+		NextID:  1,
+	}
+	if err := os.MkdirAll(q.logs, 0700); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, q); err != nil {
+			return nil, fmt.Errorf("%s: %v", q.path, err)
+		}
+	}
+	// jobs of a daemon that was stopped are run again
+	for _, job := range q.Jobs {
+		if job.State == jobRunning {
+			job.State = jobQueued
+		}
+	}
+	return q, q.save()
+}
+
+// save writes the queue, through a temporary file so a crash cannot leave
+// half of it
+func (q *jobQueue) save() error {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+func (q *jobQueue) saveOrWarn() {
+	if err := q.save(); err != nil {
+		color.Red("Jobs : " + err.Error())
+	}
+}
+
+func (q *jobQueue) logPath(job *Job) string {
+	return filepath.Join(q.logs, job.ID+".log")
+}
+
+func (q *jobQueue) find(id string) *Job {
+	for _, job := range q.Jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// add queues a job and starts it when a slot is free
+func (q *jobQueue) add(job *Job) error {
+	if err := job.validate(); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.ID = strconv.Itoa(q.NextID)
+	job.State = jobQueued
+	job.Created = time.Now().UTC()
+	job.Started, job.Finished, job.Error, job.Artifacts = time.Time{}, time.Time{}, "", nil
+	q.NextID++
+	q.Jobs = append(q.Jobs, job)
+	if err := q.save(); err != nil {
+		return err
+	}
+	q.schedule()
+	return nil
+}
+
+// schedule starts queued jobs in order up to the limit, q.mu is held
+func (q *jobQueue) schedule() {
+	for _, job := range q.Jobs {
+		if len(q.running) >= q.limit {
+			return
+		}
+		if job.State == jobQueued {
+			q.start(job)
+		}
+	}
+}
+
+func (q *jobQueue) start(job *Job) {
+	job.State, job.Started = jobRunning, time.Now().UTC()
+	defer q.saveOrWarn()
+	log, err := os.Create(q.logPath(job))
+	if err != nil {
+		job.State, job.Error, job.Finished = jobFailed, err.Error(), time.Now().UTC()
+		return
+	}
+	cmd := exec.Command(q.exe, job.args()...) // #nosec G204 -- the arguments are validated
+	cmd.Stdout, cmd.Stderr = log, log
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		job.State, job.Error, job.Finished = jobFailed, err.Error(), time.Now().UTC()
+		return
+	}
+	q.running[job.ID] = cmd
+	q.wg.Add(1)
+	fmt.Printf("Job %s : %s started (%s)\n", job.ID, job.ISBN, strings.Join(job.Formats, ","))
+	go func() {
+		defer q.wg.Done()
+		err := cmd.Wait()
+		log.Close()
+		q.finish(job, err)
+	}()
+}
+
+// finish records how a job ended and what it wrote
+func (q *jobQueue) finish(job *Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.ID)
+	job.Finished = time.Now().UTC()
+
+	output, _ := ioutil.ReadFile(q.logPath(job))
+	job.Artifacts = nil
+	for _, re := range []*regexp.Regexp{jobOutputRe, jobSkippedRe} {
+		for _, m := range re.FindAllStringSubmatch(string(output), -1) {
+			path, _ := filepath.Abs(strings.TrimSpace(m[1]))
+			job.Artifacts = append(job.Artifacts, path)
+		}
+	}
+	switch {
+	case job.State == jobCanceled:
+	case q.stopping && err != nil:
+		// stopped with the daemon, it runs again on the next start
+		job.State = jobQueued
+	case err != nil:
+		job.State = jobFailed
+		job.Error = err.Error()
+		lines := strings.Split(lastLines(string(output), 5), "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			if strings.TrimSpace(lines[i]) != "" {
+				job.Error = strings.TrimSpace(lines[i])
+				break
+			}
+		}
+	default:
+		job.State = jobDone
+	}
+	fmt.Printf("Job %s : %s %s\n", job.ID, job.ISBN, job.State)
+	q.saveOrWarn()
+	q.schedule()
+}
+
+// stopProcess asks a job to stop so it removes its temp files, Windows
+// cannot signal and kills it
+func stopProcess(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// cancel stops a queued or running job, a finished job is removed with its
+// log. The files it wrote are kept.
+func (q *jobQueue) cancel(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := q.find(id)
+	if job == nil {
+		return nil, nil
+	}
+	switch job.State {
+	case jobQueued:
+		job.State, job.Finished = jobCanceled, time.Now().UTC()
+	case jobRunning:
+		job.State = jobCanceled
+		stopProcess(q.running[id])
+	default:
+		for i, j := range q.Jobs {
+			if j == job {
+				q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+				break
+			}
+		}
+		os.Remove(q.logPath(job))
+	}
+	return job, q.save()
+}
+
+// stop ends the running jobs and waits for them to exit, they are queued
+// again for the next start. Jobs still running after jobStopTimeout are killed
+func (q *jobQueue) stop() {
+	q.mu.Lock()
+	q.stopping = true
+	q.limit = 0
+	for id, cmd := range q.running {
+		stopProcess(cmd)
+		if job := q.find(id); job != nil && job.State == jobRunning {
+			job.State = jobQueued
+		}
+	}
+	q.saveOrWarn()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(jobStopTimeout):
+		q.mu.Lock()
+		for id, cmd := range q.running {
+			color.Yellow("Job %s : still running after %s, killed", id, jobStopTimeout)
+			cmd.Process.Kill()
+		}
+		q.mu.Unlock()
+		<-done
+	}
+}
+
+// snapshot copies a job so it can be encoded without the lock
+func (q *jobQueue) snapshot(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job := q.find(id); job != nil {
+		return *job, true
+	}
+	return Job{}, false
+}
+
+func (q *jobQueue) list(state string) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := []Job{}
+	for _, job := range q.Jobs {
+		if state == "" || job.State == state {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+func apiResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+// jobsHandler is the REST API of the daemon:
+//
+//	GET    /jobs[?state=]            list the jobs
+//	POST   /jobs                     queue {"isbn", "formats", "options"}
+//	GET    /jobs/<id>                state of a job
+//	DELETE /jobs/<id>                cancel a job, or remove a finished one
+//	GET    /jobs/<id>/log            output of the job
+//	GET    /jobs/<id>/artifacts/<n>  a file the job wrote
+func jobsHandler(q *jobQueue, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			apiResponse(w, http.StatusOK, q.list(r.URL.Query().Get("state")))
+		case http.MethodPost:
+			var job Job
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&job); err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := q.add(&job); err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			created, _ := q.snapshot(job.ID)
+			w.Header().Set("Location", "/jobs/"+job.ID)
+			apiResponse(w, http.StatusCreated, created)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			apiError(w, http.StatusMethodNotAllowed, errors.New("use GET or POST"))
+		}
+	})
+
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		job, ok := q.snapshot(parts[0])
+		if !ok {
+			apiError(w, http.StatusNotFound, fmt.Errorf("no job %q", parts[0]))
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			apiResponse(w, http.StatusOK, job)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			canceled, err := q.cancel(job.ID)
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, err)
+				return
+			}
+			apiResponse(w, http.StatusOK, canceled)
+		case len(parts) == 2 && parts[1] == "log" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, q.logPath(&job))
+		case len(parts) == 3 && parts[1] == "artifacts" && r.Method == http.MethodGet:
+			n, err := strconv.Atoi(parts[2])
+			if err != nil || n < 0 || n >= len(job.Artifacts) {
+				apiError(w, http.StatusNotFound, fmt.Errorf("no artifact %q", parts[2]))
+				return
+			}
+			path := job.Artifacts[n]
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				apiError(w, http.StatusNotFound, fmt.Errorf("%s is a directory or was removed", filepath.Base(path)))
+				return
+			}
+			w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(filepath.Base(path), `"`, "", -1)+`"`)
+			http.ServeFile(w, r, path)
+		default:
+			apiError(w, http.StatusNotFound, errors.New("unknown route"))
+		}
+	})
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiError(w, http.StatusUnauthorized, errors.New("missing or wrong API token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Daemon serves the job API until it is interrupted, jobs still running
+// then are run again on the next start
+func Daemon() error {
+	// --listen of serve maps to another setting
+	addr := setting("daemon.listen", "127.0.0.1:8081")
+	if value, ok := flags["listen"]; ok {
+		addr = value
+	}
+	limit, err := strconv.Atoi(flagValue("jobs", "2"))
+	if err != nil || limit < 1 {
+		return fmt.Errorf("invalid --jobs %q, use a number above 0", flagValue("jobs", "2"))
+	}
+	token := flagValue("api-token", "")
+	if host, _, err := net.SplitHostPort(addr); err == nil && token == "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			color.Yellow("Daemon : " + addr + " is reachable from the network without --api-token, anyone there can download books with your account")
+		}
+	}
+
+	q, err := openJobQueue(dataDir(), limit)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.schedule()
+	q.mu.Unlock()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		q.stop()
+		os.Exit(0)
+	}()
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           jobsHandler(q, token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Printf("Job API on http://%s/jobs, %d jobs at a time\n", addr, limit)
+	return server.ListenAndServe()
+}
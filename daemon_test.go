@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJobArgs(t *testing.T) {
+	saved := flags
+	defer func() { flags = saved }()
+
+	tests := []struct {
+		name  string
+		flags map[string]string
+		job   Job
+		want  []string
+	}{
+		{"no options", map[string]string{}, Job{ISBN: "9781800207974", Formats: []string{"epub"}},
+			[]string{"get", "9781800207974", "--format", "epub"}},
+		{"job options", map[string]string{}, Job{ISBN: "9781800207974", Formats: []string{"epub", "pdf"},
+			Options: map[string]string{"on-conflict": "skip", "line-numbers": "true", "force": "false"}},
+			[]string{"get", "9781800207974", "--format", "epub,pdf", "--line-numbers", "--on-conflict", "skip"}},
+		{"daemon options come last", map[string]string{"output-dir": "/srv/books", "force": "true", "listen": ":8081", "jobs": "2", "api-token": "s3cret"},
+			Job{ISBN: "9781800207974", Formats: []string{"azw3"}, Options: map[string]string{"name-template": "{isbn}"}},
+			[]string{"get", "9781800207974", "--format", "azw3", "--name-template", "{isbn}", "--force", "--output-dir", "/srv/books"}},
+	}
+	for _, tt := range tests {
+		flags = tt.flags
+		if got := tt.job.args(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: args = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJobValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		job         Job
+		wantFormats []string
+		wantErr     bool
+	}{
+		{"default format", Job{ISBN: "9781800207974"}, []string{"epub"}, false},
+		{"formats normalized", Job{ISBN: "978-1-80020-797-4", Formats: []string{"EPUB", " pdf"}}, []string{"epub", "pdf"}, false},
+		{"allowed option", Job{ISBN: "9781800207974", Formats: []string{"epub"}, Options: map[string]string{"images": "kindle"}}, []string{"epub"}, false},
+		{"invalid isbn", Job{ISBN: "../etc/passwd"}, nil, true},
+		{"empty isbn", Job{}, nil, true},
+		{"unknown format", Job{ISBN: "9781800207974", Formats: []string{"docx"}}, nil, true},
+		{"daemon option", Job{ISBN: "9781800207974", Options: map[string]string{"output-dir": "/"}}, nil, true},
+		{"converter option", Job{ISBN: "9781800207974", Options: map[string]string{"calibre-path": "/bin/sh"}}, nil, true},
+	}
+	for _, tt := range tests {
+		err := tt.job.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(tt.job.Formats, tt.wantFormats) {
+			t.Errorf("%s: formats = %q, want %q", tt.name, tt.job.Formats, tt.wantFormats)
+		}
+	}
+}
+
+func TestJobFinish(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		stopping bool
+		state    string
+		err      error
+		want     string
+	}{
+		{"done", false, jobRunning, nil, jobDone},
+		{"failed", false, jobRunning, errors.New("exit status 1"), jobFailed},
+		{"canceled", false, jobCanceled, errors.New("signal: terminated"), jobCanceled},
+		{"stopped with the daemon", true, jobQueued, errors.New("signal: terminated"), jobQueued},
+		{"done while stopping", true, jobQueued, nil, jobDone},
+	}
+	for _, tt := range tests {
+		job := &Job{ID: "1", ISBN: "9781800207974", State: tt.state}
+		q := &jobQueue{path: filepath.Join(dir, "jobs.json"), logs: dir, running: map[string]*exec.Cmd{}, stopping: tt.stopping, Jobs: []*Job{job}}
+		q.finish(job, tt.err)
+		if job.State != tt.want {
+			t.Errorf("%s: state = %s, want %s", tt.name, job.State, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var (
+	opfModifiedRe = regexp.MustCompile(`(<meta\b[^>]*property="dcterms:modified"[^>]*>)[^<]*(</meta>)`)
+	opfManifestRe = regexp.MustCompile(`(?s)(<manifest\b[^>]*>)(.*?)(</manifest>)`)
+	opfFullItemRe = regexp.MustCompile(`(?s)<item\b[^>]*?(?:/>|>\s*</item>)`)
+	opfHrefRe     = regexp.MustCompile(`\shref="([^"]*)"`)
+)
+
+// deterministic tells if files have to be byte for byte the same for the
+// same book, dates then come from the publication date instead of the clock
+func deterministic() bool {
+	return flagValue("deterministic", "false") == "true"
+}
+
+// buildTime is the date written in the files of a book, zip files cannot
+// hold dates before 1980
+func buildTime(book *Book) time.Time {
+	if !deterministic() {
+		return time.Now()
+	}
+	date := book.Summary.PublicationDate.UTC()
+	if date.Year() < 1980 {
+		return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return date
+}
+
+// sortManifest orders the items of a package document by href
+func sortManifest(opf []byte, modified time.Time) []byte {
+	opf = opfModifiedRe.ReplaceAll(opf, []byte("${1}"+modified.Format("2006-01-02T15:04:05Z")+"${2}"))
+	return opfManifestRe.ReplaceAllFunc(opf, func(manifest []byte) []byte {
+		m := opfManifestRe.FindSubmatch(manifest)
+		items := opfFullItemRe.FindAll(m[2], -1)
+		sort.SliceStable(items, func(i, j int) bool {
+			return string(opfHrefRe.FindSubmatch(items[i])[1]) < string(opfHrefRe.FindSubmatch(items[j])[1])
+		})
+		out := append([]byte{}, m[1]...)
+		for _, item := range items {
+			out = append(append(out, "\n    "...), item...)
+		}
+		return append(append(out, "\n  "...), m[3]...)
+	})
+}
+
+// normalizeEpub rewrites an EPUB so the same content always gives the same
+// bytes: mimetype first then the entries sorted by name, one modification
+// date on all of them and in the package document, and a sorted manifest
+func normalizeEpub(src string, dst string, modified time.Time) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	entries := append([]*zip.File{}, r.File...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Name == "mimetype" || entries[j].Name == "mimetype" {
+			return entries[i].Name == "mimetype"
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := zip.NewWriter(out)
+	for _, f := range entries {
+		header := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: modified}
+		if f.Name == "mimetype" {
+			header.Method = zip.Store
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if path.Ext(f.Name) == ".opf" {
+			data = sortManifest(data, modified)
+		}
+		fw, err := w.CreateHeader(header)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
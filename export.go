@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+func init() {
+	RegisterWriter("markdown", dirWriter{writerFunc{"-markdown", ExportMarkdown}})
+	RegisterWriter("site", dirWriter{writerFunc{"-site", ExportSite}})
+	RegisterWriter("html", writerFunc{".html", WriteHtml})
+}
+
+// slug makes a file name friendly version of a title
+func slug(title string) string {
+	s := strings.Trim(slugRe.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(s) > 50 {
+		s = strings.TrimRight(s[:50], "-")
+	}
+	if s == "" {
+		s = "section"
+	}
+	return s
+}
+
+// sectionPaths names the file of every section as chapterNN/MM-slug.ext,
+// the page that opens a chapter is number 00
+func sectionPaths(book *Book, ext string) []string {
+	paths := make([]string, len(book.Sections))
+	chapter, section := 0, 0
+	for i, s := range book.Sections {
+		if s.Level == 0 || i == 0 {
+			chapter++
+			section = 0
+		} else {
+			section++
+		}
+		paths[i] = fmt.Sprintf("chapter%02d/%02d-%s.%s", chapter, section, slug(s.Title), ext)
+	}
+	return paths
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func imageExtension(file string) string {
+	head := make([]byte, 512)
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	n, _ := f.Read(head)
+	switch http.DetectContentType(head[:n]) {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/jpeg":
+		return ".jpg"
+	}
+	return filepath.Ext(file)
+}
+
+// copyImages puts the images of the book in dir/images, the sections refer
+// to them as ../images/<name>. It returns the path of the cover in dir.
+func copyImages(book *Book, dir string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		return "", err
+	}
+	for _, image := range book.Assets {
+		if err := copyFile(image.Path, filepath.Join(dir, "images", image.Name)); err != nil {
+			return "", err
+		}
+	}
+	if book.Cover == "" {
+		return "", nil
+	}
+	cover := "images/cover" + imageExtension(book.Cover)
+	return cover, copyFile(book.Cover, filepath.Join(dir, filepath.FromSlash(cover)))
+}
+
+func writeFile(dir string, name string, data string) error {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// ExportMarkdown writes one Markdown file per chapter and section with an
+// index.md listing them
+func ExportMarkdown(book *Book, dir string) error {
+	cover, err := copyImages(book, dir)
+	if err != nil {
+		return err
+	}
+	paths := sectionPaths(book, "md")
+
+	var index strings.Builder
+	index.WriteString("# " + book.Title + "\n\n")
+	if cover != "" {
+		index.WriteString("![Cover](" + cover + ")\n\n")
+	}
+	index.WriteString("*" + book.Author + "*\n\n")
+	if book.Description != "" {
+		index.WriteString(HtmlToMarkdown(book.Description) + "\n")
+	}
+	index.WriteString("## Contents\n\n")
+	for i, section := range book.Sections {
+		if err := writeFile(dir, paths[i], HtmlToMarkdown(section.Body)); err != nil {
+			return err
+		}
+	}
+	for _, chapter := range book.Nav() {
+		index.WriteString(fmt.Sprintf("- [%s](%s)\n", mdEscaper.Replace(chapter.Title), paths[chapter.Section]))
+		for _, section := range chapter.Children {
+			index.WriteString(fmt.Sprintf("  - [%s](%s)\n", mdEscaper.Replace(section.Title), paths[section.Section]))
+		}
+	}
+	return writeFile(dir, "index.md", index.String())
+}
+
+type siteLink struct {
+	Title   string
+	Path    string
+	Level   int
+	Current bool
+}
+
+type sitePage struct {
+	Book  string
+	Title string
+	Lang  string
+	Root  string
+	Toc   []siteLink
+	Body  template.HTML
+	Prev  string
+	Next  string
+}
+
+type searchEntry struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Text  string `json:"text"`
+}
+
+var siteTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - {{.Book}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+</head>
+<body>
+<nav class="toc">
+<a class="home" href="{{.Root}}index.html">{{.Book}}</a>
+<form action="{{.Root}}search.html"><input type="search" name="q" placeholder="Search"></form>
+<ul>
+{{- range .Toc}}
+<li class="level{{.Level}}{{if .Current}} current{{end}}"><a href="{{$.Root}}{{.Path}}">{{.Title}}</a></li>
+{{- end}}
+</ul>
+</nav>
+<main>
+{{.Body}}
+<p class="pager">{{if .Prev}}<a href="{{.Root}}{{.Prev}}">&larr; Previous</a>{{end}} {{if .Next}}<a href="{{.Root}}{{.Next}}">Next &rarr;</a>{{end}}</p>
+</main>
+</body>
+</html>
+`))
+
+const siteCSS = `body { margin: 0; font-family: Georgia, serif; line-height: 1.5; color: #222; }
+nav.toc { position: fixed; top: 0; left: 0; bottom: 0; width: 18em; overflow-y: auto; padding: 1em; background: #f6f6f6; border-right: 1px solid #ddd; font-family: sans-serif; font-size: 0.85em; }
+nav.toc ul { list-style: none; padding: 0; }
+nav.toc li.level1 { padding-left: 1em; }
+nav.toc li.current > a { font-weight: bold; }
+nav.toc a { color: #333; text-decoration: none; }
+nav.toc a.home { font-weight: bold; font-size: 1.1em; }
+nav.toc input { width: 100%; margin: 1em 0; box-sizing: border-box; }
+main { margin-left: 20em; max-width: 50em; padding: 1em 2em; }
+main img { max-width: 100%; }
+.pager { display: flex; justify-content: space-between; margin-top: 3em; }
+#results li { margin-bottom: 1em; }
+@media (max-width: 50em) { nav.toc { position: static; width: auto; } main { margin-left: 0; } }
+`
+
+const siteSearchJS = `(function () {
+  var query = new URLSearchParams(window.location.search).get("q") || "";
+  var input = document.querySelector("nav input[name=q]");
+  if (input) { input.value = query; }
+  var terms = query.toLowerCase().split(/\s+/).filter(Boolean);
+  var list = document.getElementById("results");
+  if (!terms.length) { return; }
+  var found = 0;
+  SEARCH_INDEX.forEach(function (entry) {
+    var text = entry.text.toLowerCase();
+    var title = entry.title.toLowerCase();
+    if (!terms.every(function (t) { return text.indexOf(t) >= 0 || title.indexOf(t) >= 0; })) { return; }
+    var at = Math.max(0, text.indexOf(terms[0]) - 80);
+    var li = document.createElement("li");
+    var a = document.createElement("a");
+    a.href = entry.url;
+    a.textContent = entry.title;
+    var p = document.createElement("div");
+    p.textContent = (at > 0 ? "..." : "") + entry.text.substr(at, 240) + "...";
+    li.appendChild(a);
+    li.appendChild(p);
+    list.appendChild(li);
+    found++;
+  });
+  document.getElementById("summary").textContent = found + " result(s) for “" + query + "”";
+})();
+`
+
+func plainText(body string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tagRe.ReplaceAllString(body, " "))), " ")
+}
+
+func renderPage(dir string, name string, page sitePage) error {
+	var b strings.Builder
+	if err := siteTemplate.Execute(&b, page); err != nil {
+		return err
+	}
+	return writeFile(dir, name, b.String())
+}
+
+// ExportSite writes the book as a static html site with a navigation bar
+// and a client side search that also works from the file system
+func ExportSite(book *Book, dir string) error {
+	cover, err := copyImages(book, dir)
+	if err != nil {
+		return err
+	}
+	paths := sectionPaths(book, "html")
+
+	toc := make([]siteLink, len(book.Sections))
+	var index []searchEntry
+	for i, section := range book.Sections {
+		toc[i] = siteLink{Title: section.Title, Path: paths[i], Level: section.Level}
+		index = append(index, searchEntry{Title: section.Title, URL: paths[i], Text: plainText(section.Body)})
+	}
+
+	for i, section := range book.Sections {
+		links := append([]siteLink(nil), toc...)
+		links[i].Current = true
+		page := sitePage{
+			Book:  book.Title,
+			Title: section.Title,
+			Lang:  book.Language,
+			Root:  "../",
+			Toc:   links,
+			Body:  template.HTML(section.Body), // #nosec G203 -- the book content is html by design
+		}
+		if i > 0 {
+			page.Prev = paths[i-1]
+		}
+		if i+1 < len(paths) {
+			page.Next = paths[i+1]
+		}
+		if err := renderPage(dir, paths[i], page); err != nil {
+			return err
+		}
+	}
+
+	var home strings.Builder
+	home.WriteString("<h1>" + html.EscapeString(book.Title) + "</h1>\n")
+	if cover != "" {
+		home.WriteString(`<p><img src="` + cover + `" alt="Cover"/></p>` + "\n")
+	}
+	home.WriteString("<p><em>" + html.EscapeString(book.Author) + "</em></p>\n" + book.Description + "\n")
+	first := ""
+	if len(paths) > 0 {
+		first = paths[0]
+	}
+	err = renderPage(dir, "index.html", sitePage{
+		Book: book.Title, Title: book.Title, Lang: book.Language, Toc: toc,
+		Body: template.HTML(home.String()), // #nosec G203
+		Next: first,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = renderPage(dir, "search.html", sitePage{
+		Book: book.Title, Title: "Search", Lang: book.Language, Toc: toc,
+		Body: template.HTML(`<h1>Search</h1><p id="summary"></p><ol id="results"></ol>` +
+			`<script src="search-index.js"></script><script src="search.js"></script>`), // #nosec G203
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(dir, "search-index.js", "var SEARCH_INDEX = "+string(data)+";\n"); err != nil {
+		return err
+	}
+	if err := writeFile(dir, "search.js", siteSearchJS); err != nil {
+		return err
+	}
+	return writeFile(dir, "style.css", siteCSS+book.CSS)
+}
+
+var imageSrcRe = regexp.MustCompile(`src="\.\./images/([^"]+)"`)
+
+type singlePage struct {
+	Title    string
+	Author   string
+	Lang     string
+	CSS      template.CSS
+	Cover    template.URL
+	Toc      []siteLink
+	Sections []template.HTML
+}
+
+var singleTemplate = template.Must(template.New("single").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 50em; margin: 0 auto; padding: 1em 2em; font-family: Georgia, serif; line-height: 1.5; color: #222; }
+img { max-width: 100%; }
+nav li.level1 { margin-left: 1.5em; }
+{{.CSS}}
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Cover}}<p><img src="{{.Cover}}" alt="Cover"/></p>{{end}}
+<p><em>{{.Author}}</em></p>
+<nav>
+<ul>
+{{- range .Toc}}
+<li class="level{{.Level}}"><a href="#{{.Path}}">{{.Title}}</a></li>
+{{- end}}
+</ul>
+</nav>
+{{range $i, $body := .Sections}}
+<section id="{{(index $.Toc $i).Path}}">
+{{$body}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+// imageType is the media type of an image file from its extension, the
+// content is only sniffed for unknown ones, sniffing takes SVG for XML
+func imageType(file string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == ".svg" {
+		return "image/svg+xml"
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return http.DetectContentType(data)
+}
+
+// dataURI inlines an image file
+func dataURI(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return "data:" + imageType(file, data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// WriteHtml writes the book as one self contained html file with the
+// images inlined as data URIs
+func WriteHtml(book *Book, path string) error {
+	images := map[string]string{}
+	for _, image := range book.Assets {
+		images[image.Name] = image.Path
+	}
+	inline := func(src string) string {
+		name := imageSrcRe.FindStringSubmatch(src)[1]
+		if file, ok := images[name]; ok {
+			if uri := dataURI(file); uri != "" {
+				return `src="` + uri + `"`
+			}
+		}
+		return src
+	}
+
+	page := singlePage{
+		Title:  book.Title,
+		Author: book.Author,
+		Lang:   book.Language,
+		CSS:    template.CSS(book.CSS),
+	}
+	if book.Cover != "" {
+		page.Cover = template.URL(dataURI(book.Cover)) // #nosec G203
+	}
+	for i, section := range book.Sections {
+		page.Toc = append(page.Toc, siteLink{Title: section.Title, Path: fmt.Sprintf("section-%d", i+1), Level: section.Level})
+		page.Sections = append(page.Sections, template.HTML(imageSrcRe.ReplaceAllStringFunc(section.Body, inline))) // #nosec G203
+	}
+
+	var b strings.Builder
+	if err := singleTemplate.Execute(&b, page); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0644)
+}
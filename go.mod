@@ -0,0 +1,33 @@
+module github.com/ne0z/GoPacktpub-Downloader
+
+go 1.25.0
+
+require (
+	github.com/alecthomas/chroma/v2 v2.27.0
+	github.com/bmaupin/go-epub v1.1.0
+	github.com/cavaliercoder/grab v2.0.0+incompatible
+	github.com/cheggaaa/pb v1.0.30
+	github.com/fatih/color v1.19.0
+	github.com/go-pdf/fpdf v0.9.0
+	github.com/howeyc/gopass v0.0.0-20210920133722-c8aef6fb66ef
+	github.com/joho/godotenv v1.5.1
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/image v0.12.0
+)
+
+require (
+	github.com/dlclark/regexp2/v2 v2.2.1 // indirect
+	github.com/gabriel-vasile/mimetype v1.3.1 // indirect
+	github.com/gofrs/uuid v3.1.0+incompatible // indirect
+	github.com/mattn/go-colorable v0.1.14 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-runewidth v0.0.4 // indirect
+	github.com/vincent-petithory/dataurl v0.0.0-20191104211930-d1553a71de50 // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
+	golang.org/x/net v0.6.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
+	golang.org/x/term v0.5.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
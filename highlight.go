@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// HighlightConfig controls how code listings are rendered into sections
+type HighlightConfig struct {
+	Theme       string // "color", "eink" or "none"
+	LineNumbers bool
+	Wrap        bool // wrap long lines instead of scrolling them
+}
+
+// CodeBlock is a <pre> listing found in a downloaded section
+type CodeBlock struct {
+	Start int
+	End   int
+	Lang  string
+	Code  string
+}
+
+// einkStyle avoids colors entirely, e-ink screens only show gray levels
+var einkStyle = chroma.MustNewStyle("packt-eink", chroma.StyleEntries{
+	chroma.Background:        "#000000 bg:#ffffff",
+	chroma.Keyword:           "bold #000000",
+	chroma.KeywordType:       "bold #000000",
+	chroma.NameFunction:      "bold #000000",
+	chroma.NameClass:         "bold #000000",
+	chroma.NameTag:           "bold #000000",
+	chroma.NameBuiltin:       "#000000",
+	chroma.NameAttribute:     "#333333",
+	chroma.LiteralString:     "#444444",
+	chroma.LiteralNumber:     "#444444",
+	chroma.Comment:           "italic #666666",
+	chroma.CommentPreproc:    "bold #333333",
+	chroma.Operator:          "#000000",
+	chroma.GenericPrompt:     "bold #666666",
+	chroma.GenericOutput:     "#444444",
+	chroma.GenericDeleted:    "#666666",
+	chroma.GenericInserted:   "bold #000000",
+	chroma.GenericHeading:    "bold #000000",
+	chroma.GenericSubheading: "bold #333333",
+	chroma.GenericEmph:       "italic",
+	chroma.GenericStrong:     "bold",
+	chroma.LineNumbers:       "#888888",
+})
+
+var (
+	preRe      = regexp.MustCompile(`(?s)<pre\b([^>]*)>(.*?)</pre>`)
+	innerCode  = regexp.MustCompile(`(?s)^\s*<code\b([^>]*)>(.*)</code>\s*$`)
+	tagRe      = regexp.MustCompile(`(?s)<[^>]*>`)
+	brRe       = regexp.MustCompile(`<br\s*/?>`)
+	lineNoRe   = regexp.MustCompile(`<span class="lnt?"[^>]*>[^<]*</span>`)
+	langHintRe = regexp.MustCompile(`(?:language|lang|hljs)-([\w+#-]+)`)
+	langAttrRe = regexp.MustCompile(`(?:data-code-language|data-lang|lang)="([^"]+)"`)
+)
+
+// Packt marks every listing with these, they say nothing about the language
+var genericHints = map[string]bool{
+	"code":  true,
+	"none":  true,
+	"plain": true,
+	"text":  true,
+}
+
+var langAliases = map[string]string{
+	"con":     "console",
+	"shell":   "bash",
+	"sh":      "bash",
+	"cmd":     "batch",
+	"js":      "javascript",
+	"ts":      "typescript",
+	"py":      "python",
+	"golang":  "go",
+	"yml":     "yaml",
+	"c#":      "csharp",
+	"cs":      "csharp",
+	"c++":     "cpp",
+	"ps":      "powershell",
+	"ps1":     "powershell",
+	"dockerf": "docker",
+}
+
+func codeLanguage(attrs string) string {
+	for _, m := range langAttrRe.FindAllStringSubmatch(attrs, -1) {
+		if lang := normalizeLang(m[1]); lang != "" {
+			return lang
+		}
+	}
+	for _, m := range langHintRe.FindAllStringSubmatch(attrs, -1) {
+		if lang := normalizeLang(m[1]); lang != "" {
+			return lang
+		}
+	}
+	return ""
+}
+
+func normalizeLang(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if genericHints[lang] {
+		return ""
+	}
+	if alias, ok := langAliases[lang]; ok {
+		return alias
+	}
+	return lang
+}
+
+// FindCodeBlocks returns every <pre> listing of a section with its language hint
+func FindCodeBlocks(in string) []CodeBlock {
+	var blocks []CodeBlock
+	for _, m := range preRe.FindAllStringSubmatchIndex(in, -1) {
+		attrs := in[m[2]:m[3]]
+		body := in[m[4]:m[5]]
+		if c := innerCode.FindStringSubmatch(body); c != nil {
+			attrs += " " + c[1]
+			body = c[2]
+		}
+		body = brRe.ReplaceAllString(body, "\n")
+		body = lineNoRe.ReplaceAllString(body, "")
+		body = html.UnescapeString(tagRe.ReplaceAllString(body, ""))
+		blocks = append(blocks, CodeBlock{
+			Start: m[0],
+			End:   m[1],
+			Lang:  codeLanguage(attrs),
+			Code:  strings.Trim(body, "\r\n"),
+		})
+	}
+	return blocks
+}
+
+func highlightStyle(theme string) *chroma.Style {
+	if theme == "eink" {
+		return einkStyle
+	}
+	if style := styles.Get("github"); style != nil {
+		return style
+	}
+	return styles.Fallback
+}
+
+func codeLexer(block CodeBlock) chroma.Lexer {
+	lexer := lexers.Get(block.Lang)
+	if lexer == nil {
+		lexer = lexers.Analyse(block.Code)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// HighlightSection replaces the code listings of a section with highlighted spans
+func HighlightSection(in string, cfg HighlightConfig) string {
+	if cfg.Theme == "none" {
+		return in
+	}
+	blocks := FindCodeBlocks(in)
+	if len(blocks) == 0 {
+		return in
+	}
+
+	style := highlightStyle(cfg.Theme)
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(cfg.LineNumbers),
+		chromahtml.WrapLongLines(cfg.Wrap),
+		chromahtml.TabWidth(4),
+	)
+
+	var out strings.Builder
+	last := 0
+	for _, block := range blocks {
+		iterator, err := codeLexer(block).Tokenise(nil, block.Code)
+		if err != nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := formatter.Format(&buf, style, iterator); err != nil {
+			continue
+		}
+		highlighted := buf.String()
+		if block.Lang != "" {
+			// keep the hint for the writers that need the plain listing back
+			highlighted = strings.Replace(highlighted, "<pre", `<pre data-code-language="`+block.Lang+`"`, 1)
+		}
+		out.WriteString(in[last:block.Start])
+		out.WriteString(highlighted)
+		last = block.End
+	}
+	out.WriteString(in[last:])
+	return out.String()
+}
+
+// HighlightCSS returns the stylesheet matching the spans of HighlightSection
+func HighlightCSS(cfg HighlightConfig) string {
+	var buf bytes.Buffer
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(cfg.LineNumbers),
+	)
+	formatter.WriteCSS(&buf, highlightStyle(cfg.Theme))
+
+	if cfg.Wrap {
+		buf.WriteString("\npre.chroma { white-space: pre-wrap; word-wrap: break-word; overflow-wrap: break-word; }\n")
+	} else {
+		buf.WriteString("\npre.chroma { white-space: pre; overflow-x: auto; }\n")
+	}
+	buf.WriteString("pre.chroma { font-family: monospace; font-size: 0.85em; padding: 0.5em; }\n")
+	buf.WriteString(".chroma .ln { -webkit-user-select: none; user-select: none; margin-right: 0.8em; }\n")
+	return buf.String()
+}
+
+// highlightConfig builds the highlight settings from the command line flags
+func highlightConfig() HighlightConfig {
+	return HighlightConfig{
+		Theme:       flagValue("highlight", "color"),
+		LineNumbers: flagSet("line-numbers"),
+		Wrap:        flagValue("code-wrap", "wrap") != "scroll",
+	}
+}
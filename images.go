@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	imagecolor "image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// ImageProfile says how images are re-encoded for a kind of device
+type ImageProfile struct {
+	MaxWidth  int
+	MaxHeight int
+	Gray      bool
+	Quality   int // JPEG quality
+	Colors    int // palette size PNGs are reduced to, 0 keeps them as they are
+}
+
+// the original preset leaves images untouched, duplicates are still removed
+var imageProfiles = map[string]*ImageProfile{
+	"original": nil,
+	"kindle":   {MaxWidth: 1264, MaxHeight: 1680, Gray: true, Quality: 70, Colors: 16},
+	"tablet":   {MaxWidth: 1600, MaxHeight: 2560, Quality: 82, Colors: 256},
+}
+
+// ImageReport sums up what the image pass did
+type ImageReport struct {
+	Files      int
+	Duplicates int
+	Before     int64
+	After      int64
+}
+
+func (r ImageReport) String() string {
+	saved := 0.0
+	if r.Before > 0 {
+		saved = 100 * float64(r.Before-r.After) / float64(r.Before)
+	}
+	return fmt.Sprintf("%d images, %d duplicates removed, %.1f MB -> %.1f MB (%.0f%% saved)",
+		r.Files, r.Duplicates, float64(r.Before)/1e6, float64(r.After)/1e6, saved)
+}
+
+// flatten draws an image on white, e-ink screens and JPEG have no alpha
+func flatten(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Over)
+	return dst
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// downscale shrinks an image to fit in maxWidth x maxHeight averaging the
+// source pixels each destination pixel covers
+func downscale(src *image.RGBA, maxWidth int, maxHeight int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxWidth && h <= maxHeight {
+		return src
+	}
+	scale := float64(maxWidth) / float64(w)
+	if s := float64(maxHeight) / float64(h); s < scale {
+		scale = s
+	}
+	nw, nh := int(float64(w)*scale), int(float64(h)*scale)
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0, y1 := y*h/nh, (y+1)*h/nh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < nw; x++ {
+			x0, x1 := x*w/nw, (x+1)*w/nw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			at := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[at+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// exactPalette returns the colors of an image when it has at most max of them
+func exactPalette(img *image.RGBA, max int) imagecolor.Palette {
+	seen := map[imagecolor.RGBA]bool{}
+	var palette imagecolor.Palette
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := imagecolor.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		if !seen[c] {
+			if len(palette) == max {
+				return nil
+			}
+			seen[c] = true
+			palette = append(palette, c)
+		}
+	}
+	return palette
+}
+
+func grayPalette(levels int) imagecolor.Palette {
+	palette := make(imagecolor.Palette, levels)
+	for i := range palette {
+		v := uint8(i * 255 / (levels - 1))
+		palette[i] = imagecolor.Gray{Y: v}
+	}
+	return palette
+}
+
+// OptimizeImage re-encodes a PNG or JPEG file for a profile, other formats
+// are returned as nil
+func OptimizeImage(data []byte, profile *ImageProfile) ([]byte, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format != "png" && format != "jpeg" {
+		return nil, nil
+	}
+
+	var rgba *image.RGBA
+	if profile.Gray || format == "jpeg" {
+		rgba = flatten(src)
+	} else {
+		rgba = toRGBA(src)
+	}
+	rgba = downscale(rgba, profile.MaxWidth, profile.MaxHeight)
+
+	var img image.Image = rgba
+	if profile.Gray {
+		gray := image.NewGray(rgba.Bounds())
+		draw.Draw(gray, gray.Bounds(), rgba, image.Point{}, draw.Src)
+		img = gray
+	}
+
+	var out bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: profile.Quality})
+		return out.Bytes(), err
+	}
+
+	if profile.Colors > 0 {
+		if profile.Gray {
+			paletted := image.NewPaletted(img.Bounds(), grayPalette(profile.Colors))
+			draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, image.Point{})
+			img = paletted
+		} else if palette := exactPalette(rgba, profile.Colors); palette != nil {
+			paletted := image.NewPaletted(rgba.Bounds(), palette)
+			draw.Draw(paletted, paletted.Bounds(), rgba, image.Point{}, draw.Src)
+			img = paletted
+		}
+	}
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err = encoder.Encode(&out, img)
+	return out.Bytes(), err
+}
+
+// OptimizeImages removes images with the same content, pointing the sections
+// at the one kept, and re-encodes the others for the --images preset
+func OptimizeImages(book *Book) (ImageReport, error) {
+	var report ImageReport
+	name := flagValue("images", "original")
+	profile, ok := imageProfiles[name]
+	if !ok {
+		return report, fmt.Errorf("unknown image preset %q, use kindle, tablet or original", name)
+	}
+
+	byHash := map[[32]byte]string{}
+	renamed := map[string]string{}
+	var kept []Asset
+	for _, asset := range book.Assets {
+		data, err := ioutil.ReadFile(asset.Path)
+		if err != nil {
+			return report, err
+		}
+		report.Before += int64(len(data))
+		sum := sha256.Sum256(data)
+		if first, ok := byHash[sum]; ok {
+			renamed[asset.Name] = first
+			report.Duplicates++
+			continue
+		}
+		byHash[sum] = asset.Name
+
+		if profile != nil {
+			optimized, err := OptimizeImage(data, profile)
+			if err != nil {
+				color.Yellow("Image " + asset.Name + " left as is: " + err.Error())
+			} else if optimized != nil && len(optimized) < len(data) {
+				path := tempPath("optimized-" + asset.Name)
+				if err := ioutil.WriteFile(path, optimized, 0644); err != nil {
+					return report, err
+				}
+				os.Remove(asset.Path)
+				asset.Path = path
+				data = optimized
+			}
+		}
+		report.After += int64(len(data))
+		kept = append(kept, asset)
+	}
+	report.Files = len(kept)
+	book.Assets = kept
+
+	if len(renamed) > 0 {
+		var pairs []string
+		for from, to := range renamed {
+			pairs = append(pairs, `"../images/`+from+`"`, `"../images/`+to+`"`)
+		}
+		replacer := strings.NewReplacer(pairs...)
+		for i := range book.Sections {
+			book.Sections[i].Body = replacer.Replace(book.Sections[i].Body)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	kepubTagRe      = regexp.MustCompile(`(?s)<!--.*?-->|<!\[CDATA\[.*?\]\]>|<[^>]*>`)
+	kepubSentenceRe = regexp.MustCompile(`[.!?…]+["'”’)\]]*\s+`)
+	kepubNameRe     = regexp.MustCompile(`^</?\s*([a-zA-Z0-9:-]+)`)
+)
+
+func init() {
+	RegisterWriter("kepub", writerFunc{".kepub.epub", WriteKepub})
+}
+
+// a new Kobo paragraph starts at each of these
+var kepubParagraphs = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "li": true, "div": true, "blockquote": true, "td": true,
+	"th": true, "dt": true, "dd": true, "figcaption": true, "pre": true,
+	"caption": true,
+}
+
+const kepubStyle = `<style type="text/css" class="kobostylehacks">div#book-inner { margin-top: 0; margin-bottom: 0; }</style>`
+
+// kepubSpans wraps a text run into koboSpans, one per sentence
+type kepubSpans struct {
+	paragraph int
+	segment   int
+}
+
+func (k *kepubSpans) span(content string) string {
+	k.segment++
+	return fmt.Sprintf(`<span class="koboSpan" id="kobo.%d.%d">%s</span>`, k.paragraph, k.segment, content)
+}
+
+func (k *kepubSpans) text(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range kepubSentenceRe.FindAllStringIndex(s, -1) {
+		b.WriteString(k.sentence(s[last:m[1]]))
+		last = m[1]
+	}
+	b.WriteString(k.sentence(s[last:]))
+	return b.String()
+}
+
+// sentence keeps the whitespace around a sentence outside of its span
+func (k *kepubSpans) sentence(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return s
+	}
+	start := strings.Index(s, trimmed)
+	return s[:start] + k.span(trimmed) + s[start+len(trimmed):]
+}
+
+// Kepubify adds the markup Kobo readers rely on for reading statistics and
+// fast page turns to an xhtml document
+func Kepubify(doc string) string {
+	k := &kepubSpans{}
+	var b strings.Builder
+	inBody := false
+	skip := 0
+	last := 0
+	for _, m := range kepubTagRe.FindAllStringIndex(doc, -1) {
+		text := doc[last:m[0]]
+		if inBody && skip == 0 {
+			text = k.text(text)
+		}
+		b.WriteString(text)
+		last = m[1]
+
+		tag := doc[m[0]:m[1]]
+		name := ""
+		if n := kepubNameRe.FindStringSubmatch(tag); n != nil {
+			name = strings.ToLower(n[1])
+		}
+		closing := strings.HasPrefix(tag, "</")
+		selfClosing := strings.HasSuffix(tag, "/>")
+		switch {
+		case name == "head" && closing:
+			b.WriteString(kepubStyle + tag)
+		case name == "body" && !closing:
+			inBody = true
+			b.WriteString(tag + `<div id="book-columns"><div id="book-inner">`)
+		case name == "body":
+			inBody = false
+			b.WriteString(`</div></div>` + tag)
+		case name == "script" || name == "style" || name == "svg" || name == "math":
+			if !closing && !selfClosing {
+				skip++
+			} else if closing {
+				skip--
+			}
+			b.WriteString(tag)
+		case name == "img" && inBody && skip == 0:
+			b.WriteString(k.span(tag))
+		case kepubParagraphs[name] && !closing:
+			k.paragraph++
+			k.segment = 0
+			b.WriteString(tag)
+		default:
+			b.WriteString(tag)
+		}
+	}
+	b.WriteString(doc[last:])
+	return b.String()
+}
+
+func isContentDocument(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xhtml", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// ConvertKepub rewrites an EPUB into a Kobo KEPUB, the mimetype entry stays
+// first and uncompressed as the EPUB container requires
+func ConvertKepub(src string, dst string) error {
+	return rewriteZip(src, dst, func(name string, data []byte) []byte {
+		if isContentDocument(name) {
+			return []byte(Kepubify(string(data)))
+		}
+		return data
+	})
+}
+
+// WriteKepub writes the book as an EPUB and turns it into a KEPUB
+func WriteKepub(book *Book, path string) error {
+	epubPath := tempPath(book.Identifier + ".epub")
+	if err := WriteEpub(book, epubPath); err != nil {
+		return err
+	}
+	return ConvertKepub(epubPath, path)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	bolt "go.etcd.io/bbolt"
+)
+
+var booksBucket = []byte("books")
+
+// LibraryEntry is a book written by a build, there is one per ISBN and format
+type LibraryEntry struct {
+	ISBN        string    `json:"isbn"`
+	Title       string    `json:"title"`
+	Authors     []string  `json:"authors"`
+	Format      string    `json:"format"`
+	Path        string    `json:"path"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	BuiltAt     time.Time `json:"builtAt"`
+	ToolVersion string    `json:"toolVersion"`
+	Summary     Summary   `json:"summary"`
+
+	// what library sync compares the book against
+	Toc          TOC               `json:"toc"`
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+func (e LibraryEntry) key() []byte {
+	return []byte(e.ISBN + "/" + e.Format)
+}
+
+// Library is the catalog of the books built on this machine
+type Library struct {
+	db *bolt.DB
+}
+
+// dataDir is $XDG_DATA_HOME/packt, or ~/.local/share/packt
+func dataDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "packt")
+	}
+	return filepath.Join(usr.HomeDir, ".local", "share", "packt")
+}
+
+// OpenLibrary opens the catalog at --library or in the data directory, it
+// waits for other runs holding it
+func OpenLibrary() (*Library, error) {
+	path := flagValue("library", filepath.Join(dataDir(), "library.db"))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &Library{db: db}, nil
+}
+
+// Close releases the catalog for other runs
+func (l *Library) Close() error {
+	return l.db.Close()
+}
+
+// Put adds an entry, replacing the one of the same ISBN and format
+func (l *Library) Put(entry LibraryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(booksBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(entry.key(), data)
+	})
+}
+
+// Entries returns the entries of an ISBN, or all of them when isbn is ""
+func (l *Library) Entries(isbn string) ([]LibraryEntry, error) {
+	var entries []LibraryEntry
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(booksBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if isbn != "" && !strings.HasPrefix(string(k), isbn+"/") {
+				return nil
+			}
+			var entry LibraryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Delete removes the entries of an ISBN, only the one of a format when it
+// is not ""
+func (l *Library) Delete(isbn string, format string) (int, error) {
+	entries, err := l.Entries(isbn)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(booksBucket)
+		if b == nil {
+			return nil
+		}
+		for _, entry := range entries {
+			if format != "" && entry.Format != format {
+				continue
+			}
+			if err := b.Delete(entry.key()); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// hashFile returns the SHA-256 and size of a file, directories written by
+// the markdown and site formats are hashed over their file names and content
+func hashFile(path string) (string, int64, error) {
+	h := sha256.New()
+	var size int64
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(path, file)
+		io.WriteString(h, filepath.ToSlash(rel)+"\x00")
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(h, f)
+		size += n
+		return err
+	})
+	return hex.EncodeToString(h.Sum(nil)), size, err
+}
+
+// checkEntry tells if the file of an entry is still the one built
+func checkEntry(entry LibraryEntry) error {
+	sum, _, err := hashFile(entry.Path)
+	if os.IsNotExist(err) {
+		return errors.New("missing")
+	}
+	if err != nil {
+		return err
+	}
+	if sum != entry.SHA256 {
+		return errors.New("changed since it was built")
+	}
+	return nil
+}
+
+// upToDate finds the copy of a book in a format at path that still matches
+// the catalog and was built from the same edition, a copy elsewhere does
+// not count
+func upToDate(book *Book, format string, path string) (LibraryEntry, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return LibraryEntry{}, false
+	}
+	library, err := OpenLibrary()
+	if err != nil {
+		color.Yellow("Library : " + err.Error())
+		return LibraryEntry{}, false
+	}
+	defer library.Close()
+	entries, err := library.Entries(book.Identifier)
+	if err != nil {
+		return LibraryEntry{}, false
+	}
+	for _, entry := range entries {
+		if entry.Format != format || entry.Path != path || checkEntry(entry) != nil {
+			continue
+		}
+		s := entry.Summary
+		if s.PublicationDate.Equal(book.Summary.PublicationDate) && s.Pages == book.Summary.Pages &&
+			s.Length == book.Summary.Length && s.EarlyAccess == book.Summary.EarlyAccess {
+			return entry, true
+		}
+	}
+	return LibraryEntry{}, false
+}
+
+// recordBuild adds a written book to the catalog, a catalog that cannot be
+// written does not fail the build
+func recordBuild(book *Book, format string, path string) {
+	sum, size, err := hashFile(path)
+	if err == nil {
+		var library *Library
+		library, err = OpenLibrary()
+		if err == nil {
+			var authors []string
+			if book.Author != "" {
+				authors = strings.Split(book.Author, ", ")
+			}
+			abs, _ := filepath.Abs(path)
+			err = library.Put(LibraryEntry{
+				ISBN:        book.Identifier,
+				Title:       book.Title,
+				Authors:     authors,
+				Format:      format,
+				Path:        abs,
+				SHA256:      sum,
+				Size:        size,
+				BuiltAt:     time.Now().UTC(),
+				ToolVersion: version,
+				Summary:     book.Summary,
+
+				Toc:          book.Toc,
+				Fingerprints: book.Fingerprints,
+			})
+			library.Close()
+		}
+	}
+	if err != nil {
+		color.Yellow("Library : " + path + " not recorded: " + err.Error())
+	}
+}
+
+// removeBuild deletes what a build wrote: a regular file, or a directory of
+// the markdown and site formats when its content is still the one recorded.
+// --out can point a directory format anywhere, so a directory that changed
+// is never deleted, nor the current or home directory
+func removeBuild(entry LibraryEntry) error {
+	info, err := os.Lstat(entry.Path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		return os.Remove(entry.Path)
+	}
+	if !info.IsDir() {
+		return errors.New("not a file or directory written by a build")
+	}
+	for _, dir := range []string{".", usr.HomeDir} {
+		if same, err := os.Stat(dir); err == nil && os.SameFile(info, same) {
+			return errors.New("refusing to delete the current or home directory")
+		}
+	}
+	if err := checkEntry(entry); err != nil {
+		return err
+	}
+
+	var dirs []string
+	err = filepath.Walk(entry.Path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, file)
+			return nil
+		}
+		return os.Remove(file)
+	})
+	if err != nil {
+		return err
+	}
+	// deepest first, a directory that is not empty is kept
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+func printEntry(entry LibraryEntry) {
+	fmt.Println(entry.Title + " (" + entry.Format + ")")
+	fmt.Println("  ISBN     : " + entry.ISBN)
+	fmt.Println("  Authors  : " + strings.Join(entry.Authors, ", "))
+	fmt.Println("  Path     : " + entry.Path)
+	fmt.Printf("  Size     : %.1f MB\n", float64(entry.Size)/1e6)
+	fmt.Println("  SHA-256  : " + entry.SHA256)
+	fmt.Println("  Built    : " + entry.BuiltAt.Local().Format("2006-01-02 15:04") + " with " + entry.ToolVersion)
+	fmt.Println("  Published: " + entry.Summary.PublicationDate.Format("2006-01-02"))
+}
+
+// LibraryCommand runs packt library list|show|rm|verify, sync needs a login
+// and runs from main
+func LibraryCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: library list | show <isbn> | rm <isbn> [format] | verify | sync [isbn]")
+	}
+	library, err := OpenLibrary()
+	if err != nil {
+		return err
+	}
+	defer library.Close()
+
+	switch args[0] {
+	case "list":
+		entries, err := library.Entries("")
+		if err != nil {
+			return err
+		}
+		if flagSet("json") {
+			return printJSON(entries)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s  %-10s %s  %s\n", entry.ISBN, entry.Format, entry.BuiltAt.Local().Format("2006-01-02"), entry.Title)
+		}
+		fmt.Printf("%d books\n", len(entries))
+	case "show":
+		if len(args) != 2 {
+			return errors.New("usage: library show <isbn>")
+		}
+		entries, err := library.Entries(args[1])
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return fmt.Errorf("%s is not in the library", args[1])
+		}
+		if flagSet("json") {
+			return printJSON(entries)
+		}
+		for _, entry := range entries {
+			printEntry(entry)
+		}
+	case "rm":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: library rm <isbn> [format]")
+		}
+		format := ""
+		if len(args) == 3 {
+			format = args[2]
+		}
+		entries, err := library.Entries(args[1])
+		if err != nil {
+			return err
+		}
+		removed, err := library.Delete(args[1], format)
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return fmt.Errorf("%s is not in the library", args[1])
+		}
+		if flagSet("delete-files") {
+			for _, entry := range entries {
+				if format == "" || entry.Format == format {
+					if err := removeBuild(entry); err != nil {
+						color.Yellow(entry.Path + " not deleted: " + err.Error())
+					}
+				}
+			}
+		}
+		fmt.Printf("%d entries removed\n", removed)
+	case "verify":
+		entries, err := library.Entries("")
+		if err != nil {
+			return err
+		}
+		bad := 0
+		for _, entry := range entries {
+			if err := checkEntry(entry); err != nil {
+				bad++
+				color.Red(entry.ISBN + " " + entry.Format + ": " + entry.Path + " " + err.Error())
+			}
+		}
+		fmt.Printf("%d books checked, %d with problems\n", len(entries), bad)
+		if bad > 0 {
+			return fmt.Errorf("%d books missing or changed, rebuild them or remove them with library rm", bad)
+		}
+	default:
+		return fmt.Errorf("unknown library command %q, use list, show, rm, verify or sync", args[0])
+	}
+	return nil
+}
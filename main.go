@@ -3,31 +3,69 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/cavaliercoder/grab"
 	"github.com/cheggaaa/pb"
 	"github.com/fatih/color"
 	"github.com/howeyc/gopass"
-	"github.com/joho/godotenv"
-	"github.com/ne0z/go-epub"
 )
 
+// version is recorded in the library with every book built. Releases set it
+// with -ldflags "-X main.version=v2.1.0", see the Makefile, other builds
+// take the module version or VCS revision Go records
+var version = ""
+
+func init() {
+	if version != "" {
+		return
+	}
+	version = "devel"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+		return
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			version = "devel-" + s.Value[:12]
+		}
+	}
+}
+
 var usr, _ = user.Current()
-var tmpfiles []string
+var flags = map[string]string{}
+
+// boolFlags are the options that never take a value
+var boolFlags = map[string]bool{
+	"line-numbers":  true,
+	"keep-temp":     true,
+	"json":          true,
+	"deterministic": true,
+	"force":         true,
+	"delete-files":  true,
+	"quick":         true,
+	"dry-run":       true,
+}
 
 // Credential used to store user and password
 type Credential struct {
@@ -393,7 +431,7 @@ type SearchRequest struct {
 	Requests []ArrSearchRequest `json:"requests"`
 }
 
-func Login(username string, password string) Token {
+func Login(username string, password string) (Token, error) {
 	cred := &Credential{
 		Username: username,
 		Password: password,
@@ -415,20 +453,19 @@ func Login(username string, password string) Token {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return Token{}, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
 	var token Token
-	json.Unmarshal(body, &token)
-	return token
+	err = decodeJSON(resp, &token)
+	return token, err
 }
 
-func Search(keyword string) SearchResult {
+func Search(keyword string) (SearchResult, error) {
 	var result SearchResult
 
 	request := &SearchRequest{
@@ -457,17 +494,15 @@ func Search(keyword string) SearchResult {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return result, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, &result)
-
-	return result
+	err = decodeJSON(resp, &result)
+	return result, err
 }
 
 type Summary struct {
@@ -522,7 +557,7 @@ type Summary struct {
 	DistributionRestrictions []interface{} `json:"distributionRestrictions"`
 }
 
-func GetSummary(isbn string) Summary {
+func GetSummary(isbn string) (Summary, error) {
 	var summary Summary
 
 	req, err := http.NewRequest(
@@ -542,50 +577,37 @@ func GetSummary(isbn string) Summary {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, &summary)
-	return summary
+	err = decodeJSON(resp, &summary)
+	return summary, err
+}
+
+type TocSection struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	ContentType string `json:"contentType"`
+}
+
+type TocChapter struct {
+	ID       string       `json:"id"`
+	Title    string       `json:"title"`
+	Sections []TocSection `json:"sections"`
 }
 
 type TOC struct {
-	ProductID string `json:"productId"`
-	Prefaces  []struct {
-		ID       string `json:"id"`
-		Title    string `json:"title"`
-		Sections []struct {
-			ID          string `json:"id"`
-			Title       string `json:"title"`
-			ContentType string `json:"contentType"`
-		} `json:"sections"`
-	} `json:"prefaces"`
-	Appendices []struct {
-		ID       string `json:"id"`
-		Title    string `json:"title"`
-		Sections []struct {
-			ID          string `json:"id"`
-			Title       string `json:"title"`
-			ContentType string `json:"contentType"`
-		} `json:"sections"`
-	} `json:"appendices"`
-	Chapters []struct {
-		ID       string `json:"id"`
-		Title    string `json:"title"`
-		Sections []struct {
-			ID          string `json:"id"`
-			Title       string `json:"title"`
-			ContentType string `json:"contentType"`
-		} `json:"sections"`
-	} `json:"chapters"`
-}
-
-func GetToc(isbn string) TOC {
+	ProductID  string       `json:"productId"`
+	Prefaces   []TocChapter `json:"prefaces"`
+	Appendices []TocChapter `json:"appendices"`
+	Chapters   []TocChapter `json:"chapters"`
+}
+
+func GetToc(isbn string) (TOC, error) {
 	var toc TOC
 
 	req, err := http.NewRequest(
@@ -605,16 +627,15 @@ func GetToc(isbn string) TOC {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return toc, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, &toc)
-	return toc
+	err = decodeJSON(resp, &toc)
+	return toc, err
 }
 
 type Author struct {
@@ -626,7 +647,7 @@ type Author struct {
 	URLKey       string   `json:"urlKey"`
 }
 
-func GetAuthor(authorId string) Author {
+func GetAuthor(authorId string) (Author, error) {
 	var author Author
 
 	req, err := http.NewRequest(
@@ -646,23 +667,22 @@ func GetAuthor(authorId string) Author {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return author, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	json.Unmarshal(body, &author)
-	return author
+	err = decodeJSON(resp, &author)
+	return author, err
 }
 
 type Page struct {
 	Data string `json:"data"`
 }
 
-func GetPage(token string, isbn string, chapterId string, pageId string) Page {
+func GetPage(token string, isbn string, chapterId string, pageId string) (Page, error) {
 	var page Page
 
 	req, err := http.NewRequest(
@@ -683,16 +703,27 @@ func GetPage(token string, isbn string, chapterId string, pageId string) Page {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return page, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	err = json.Unmarshal(body, &page)
-	return page
+	err = decodeJSON(resp, &page)
+	return page, err
+}
+
+// decodeJSON reads an API response, a status other than 200 is an error
+func decodeJSON(resp *http.Response, v interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Request.URL.Path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
 }
 
 func DownloadPage(url string) (string, error) {
@@ -712,15 +743,18 @@ func DownloadPage(url string) (string, error) {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Request.URL.Path, resp.Status)
+	}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	return string(body), nil
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
 }
 
 func RemoveHtmlTag(in string) string {
@@ -746,166 +780,218 @@ func fixImgSrc(in string, isbn string) string {
 	return s
 }
 
-func DownloadAsMobi(token string, isbn string) string {
-	fileName := DownloadAsEpub(token, isbn)
+const productsURL = "https://static.packt-cdn.com/products/"
 
-	_, err := os.Stat("/Applications/calibre.app/Contents/MacOS//ebook-convert")
-	app := ""
-	if os.IsNotExist(err) {
-		app = "/usr/bin/ebook-convert"
-	} else {
-		app = "/Applications/calibre.app/Contents/MacOS//ebook-convert"
-	}
+var (
+	imgTagRe = regexp.MustCompile(`(?s)<img\b[^>]*>`)
+	srcRe    = regexp.MustCompile(`\ssrc="([^"]*)"`)
+	altRe    = regexp.MustCompile(`\salt="([^"]*)"`)
+	brTagRe  = regexp.MustCompile(`<br\b[^>]*?/?>`)
+)
 
-	cmd := &exec.Cmd{
-		Path: app,
-		Args: []string{app, fileName + ".epub", fileName + ".mobi"},
+// ImageURL resolves the src of an image of a section. Packt nests the
+// product path as /graphics/<isbn>/graphics/image/x.png, the file lives
+// under the last graphics/ of it.
+func ImageURL(isbn string, src string) string {
+	if strings.HasPrefix(src, "//") {
+		return "https:" + src
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		return src
 	}
-	cmd.Start()
-	cmd.Wait()
-	os.Remove(fileName + ".epub")
-	return fileName
+	path := src
+	if u, err := url.Parse(src); err == nil {
+		path = u.Path
+	}
+	if i := strings.LastIndex(path, "graphics/"); i >= 0 {
+		path = path[i:]
+	}
+	return productsURL + isbn + "/" + strings.TrimLeft(path, "./")
 }
 
-func fixImgInternalSrc(in string, isbn string) (string, [][]string) {
-	re := regexp.MustCompile("<img src=\"(.*?)\"")
-	matches := re.FindAllStringSubmatch(in, -1)
-	if len(matches) == 0 {
-		return in, nil
+// AssetName is a file name unique to an image URL that stays the same from
+// one run to the next, images of different chapters can share a base name
+func AssetName(imageURL string) string {
+	sum := sha256.Sum256([]byte(imageURL))
+	base := imageURL
+	if u, err := url.Parse(imageURL); err == nil {
+		base = u.Path
 	}
-
-	re = regexp.MustCompile(`/graphics/(.*?)/graphics/(.*?)/`)
-	s := re.ReplaceAllString(in, `../images/`)
-
-	re = regexp.MustCompile(`(<img)(.*?)(>)`)
-	s = re.ReplaceAllString(s, `${1}${2}/${3}`)
-
-	re = regexp.MustCompile(`(<br)(.*?)(>)`)
-	s = re.ReplaceAllString(s, `${1}${2}/${3}`)
-	return s, matches
+	return hex.EncodeToString(sum[:4]) + "-" + filepath.Base(base)
 }
 
-func FixImgUrlError(url string) string {
-	re := regexp.MustCompile(`/graphics/(.*?)/`)
-	s := re.ReplaceAllString(url, ``)
-	return s
+// DownloadImage fetches an image, retrying with a growing delay
+func DownloadImage(imageURL string, path string) error {
+	var err error
+	delay := time.Second
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err = grabFile(path, imageURL); err == nil {
+			return nil
+		}
+		if attempt < 3 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
 }
 
-func EmbedEPubImage(e *epub.Epub, isbn string, urls [][]string) {
-	for _, imgURL := range urls {
-		imagePath := usr.HomeDir + "/.packt_tmp/" + filepath.Base(imgURL[1])
-		_, err := grab.Get(imagePath,
-			"https://static.packt-cdn.com/products/"+isbn+"/"+FixImgUrlError(imgURL[1]))
-		if err != nil {
-			color.Red("Error occured!\r\n" + err.Error())
-			color.Red("https://static.packt-cdn.com/products/" + isbn + "/" + FixImgUrlError(imgURL[1]))
-			color.Red(imgURL[1])
-			continue
-		}
-		e.AddImage(imagePath, "../images/"+filepath.Base(imgURL[1]))
-		tmpfiles = append(tmpfiles, imagePath)
+// missingImage replaces an image that could not be downloaded
+func missingImage(tag string, name string) string {
+	caption := name
+	if m := altRe.FindStringSubmatch(tag); m != nil && strings.TrimSpace(m[1]) != "" {
+		caption = m[1]
 	}
+	return `<span class="missing-image">[Image not available: ` + caption + `]</span>`
 }
 
-func cleanUpFiles() {
-	dirname := usr.HomeDir + "/.packt_tmp/"
+// fixImages points the images of a section at their assets and downloads
+// the ones not seen before. Images that cannot be fetched are replaced
+// with a placeholder and added to book.Missing.
+func fixImages(book *Book, section string, page string) string {
+	page = imgTagRe.ReplaceAllStringFunc(page, func(tag string) string {
+		m := srcRe.FindStringSubmatch(tag)
+		if m == nil || strings.HasPrefix(m[1], "data:") {
+			return tag
+		}
+		imageURL := ImageURL(book.Identifier, html.UnescapeString(m[1]))
+		name := AssetName(imageURL)
+		if err, failed := book.failed[imageURL]; failed {
+			book.Missing = append(book.Missing, MissingImage{Section: section, URL: imageURL, Err: err})
+			return missingImage(tag, filepath.Base(m[1]))
+		}
+		if !book.fetched[imageURL] {
+			path := tempPath(name)
+			if err := DownloadImage(imageURL, path); err != nil {
+				book.failed[imageURL] = err
+				book.Missing = append(book.Missing, MissingImage{Section: section, URL: imageURL, Err: err})
+				return missingImage(tag, filepath.Base(m[1]))
+			}
+			book.fetched[imageURL] = true
+			book.Assets = append(book.Assets, Asset{Name: name, Path: path})
+		}
+		tag = strings.Replace(tag, m[0], ` src="../images/`+name+`"`, 1)
+		if !strings.HasSuffix(tag, "/>") {
+			tag = strings.TrimSuffix(tag, ">") + "/>"
+		}
+		return tag
+	})
+	return brTagRe.ReplaceAllString(page, "<br/>")
+}
 
-	d, err := os.Open(dirname)
+// DownloadSection fetches the html content of a single section
+func DownloadSection(token string, isbn string, chapterID string, sectionID string) (string, error) {
+	pageURL, err := GetPage(token, isbn, chapterID, sectionID)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return "", err
 	}
-	defer d.Close()
-
-	files, err := d.Readdir(-1)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if pageURL.Data == "" {
+		return "", fmt.Errorf("section %s/%s has no page", chapterID, sectionID)
 	}
+	return DownloadPage(pageURL.Data)
+}
 
-	for _, file := range files {
-		if file.Mode().IsRegular() {
-			if filepath.Ext(file.Name()) == ".png" || filepath.Ext(file.Name()) == ".jpg" || filepath.Ext(file.Name()) == "jpeg" {
-				os.Remove(file.Name())
-			}
-		}
-	}
+// TocPart is one of the groups of chapters of a book
+type TocPart struct {
+	Name     string // "preface", "chapter" or "appendix"
+	Chapters []TocChapter
 }
 
-func removeTmpFiles() {
-	for _, file := range tmpfiles {
-		os.Remove(file)
+// Parts returns the prefaces, chapters and appendices in reading order
+func (toc TOC) Parts() []TocPart {
+	return []TocPart{
+		{Name: "preface", Chapters: toc.Prefaces},
+		{Name: "chapter", Chapters: toc.Chapters},
+		{Name: "appendix", Chapters: toc.Appendices},
 	}
 }
 
-func DownloadAsEpub(token string, isbn string) string {
-	summary := GetSummary(isbn)
-	author := GetAuthor(summary.Authors[0])
-	toc := GetToc(isbn)
-	e := epub.NewEpub(summary.Title)
-	e.SetAuthor(author.Author)
-	e.SetDescription(summary.About)
-	e.SetIdentifier(isbn)
+type tocJob struct {
+	part      string
+	chapter   int
+	section   int
+	title     string
+	chapterID string
+	sectionID string
+}
 
-	coverPath := usr.HomeDir + "/.packt_tmp/" + filepath.Base(summary.CoverImage)
+// concurrency is the number of sections downloaded at the same time
+func concurrency() int {
+	n, err := strconv.Atoi(flagValue("concurrency", "4"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
 
-	_, err := grab.Get(coverPath,
-		summary.CoverImage)
-	if err != nil {
-		log.Fatal(err)
-	}
-	tmpfiles = append(tmpfiles, coverPath)
-	coverImagePath, _ := e.AddImage(coverPath, filepath.Base(summary.CoverImage))
-	e.SetCover(coverImagePath, "")
-
-	bar := pb.StartNew(len(toc.Chapters))
-	curr := 0
-	for _, chapters := range toc.Chapters {
-		bar.Increment()
-		pageURL := GetPage(token, isbn, chapters.ID, chapters.Sections[0].ID)
-		downloadedPage, err := DownloadPage(pageURL.Data)
-		if err != nil {
-			log.Fatal(pageURL)
-		}
-		pageData, imgURL := fixImgInternalSrc(downloadedPage, isbn)
-		if len(imgURL) > 0 {
-			EmbedEPubImage(e, isbn, imgURL)
-		}
-		e.AddSection(pageData, chapters.Title, "", "")
-		for _, subchapter := range chapters.Sections {
-			if curr > 0 {
-				pageURL := GetPage(token, isbn, chapters.ID, subchapter.ID)
-				downloadedPage, err := DownloadPage(pageURL.Data)
-				if err != nil {
-					log.Fatal(pageURL)
+// WalkToc downloads every section of the book, up to --concurrency at a
+// time, and reports them in reading order. The first section of a chapter
+// is reported with the chapter title. It stops at the first section that
+// cannot be downloaded.
+func WalkToc(token string, isbn string, toc TOC, fn func(part string, chapter int, section int, title string, page string)) error {
+	var jobs []tocJob
+	for _, part := range toc.Parts() {
+		for i, chapter := range part.Chapters {
+			for j, section := range chapter.Sections {
+				title := section.Title
+				if j == 0 {
+					title = chapter.Title
 				}
-				pageData, imgURL := fixImgInternalSrc(downloadedPage, isbn)
-				if len(imgURL) > 0 {
-					EmbedEPubImage(e, isbn, imgURL)
-				}
-				e.AddSection(pageData, subchapter.Title, "", "")
+				jobs = append(jobs, tocJob{part.Name, i, j, title, chapter.ID, section.ID})
 			}
-			curr++
 		}
-		curr = 0
 	}
-	bar.Finish()
 
-	err = e.Write(summary.Title + ".epub")
-	if err != nil {
-		color.Red(err.Error())
-		os.Exit(1)
+	type result struct {
+		page string
+		err  error
 	}
-	return summary.Title
+	pages := make([]chan result, len(jobs))
+	for i := range pages {
+		pages[i] = make(chan result, 1)
+	}
+	queue := make(chan int)
+	done := make(chan struct{})
+	defer close(done)
+	bar := pb.StartNew(len(jobs))
+	defer bar.Finish()
+	for w := 0; w < concurrency(); w++ {
+		go func() {
+			for i := range queue {
+				page, err := cachedSection(token, isbn, jobs[i].chapterID, jobs[i].sectionID)
+				pages[i] <- result{page, err}
+				bar.Increment()
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for i := range jobs {
+			select {
+			case queue <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i, job := range jobs {
+		r := <-pages[i]
+		if r.err != nil {
+			return fmt.Errorf("%s: %v", job.title, r.err)
+		}
+		fn(job.part, job.chapter, job.section, job.title, r.page)
+	}
+	return nil
 }
 
 type RefreshCredential struct {
 	Refresh string
 }
 
-func RefreshToken() Token {
+func RefreshToken() (Token, error) {
 	cred := &RefreshCredential{
-		Refresh: os.Getenv("TOKEN"),
+		Refresh: setting("auth.token", ""),
 	}
 	b, _ := json.Marshal(cred)
 	req, err := http.NewRequest(
@@ -924,80 +1010,249 @@ func RefreshToken() Token {
 	req.Header.Set("Referer", "https://subscription.packtpub.com/")
 	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 
-	client := &http.Client{}
+	client := httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		return Token{}, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
 	var token Token
-	json.Unmarshal(body, &token)
-	return token
+	err = decodeJSON(resp, &token)
+	return token, err
+}
+
+// parseArgs moves the --options out of args into flags and returns the rest
+func parseArgs(args []string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") || arg == "--" {
+			rest = append(rest, arg)
+			continue
+		}
+		name := strings.TrimPrefix(arg, "--")
+		if eq := strings.Index(name, "="); eq >= 0 {
+			flags[name[:eq]] = name[eq+1:]
+			continue
+		}
+		if boolFlags[name] || i+1 >= len(args) {
+			flags[name] = "true"
+			continue
+		}
+		flags[name] = args[i+1]
+		i++
+	}
+	return rest
+}
+
+// flagValue returns a command line option, then the environment and config
+// file setting it maps to, then def
+func flagValue(name string, def string) string {
+	if value, ok := flags[name]; ok {
+		return value
+	}
+	if key, ok := flagSettings[name]; ok {
+		return setting(key, def)
+	}
+	return def
+}
+
+func flagSet(name string) bool {
+	value, ok := flags[name]
+	return ok && value != "false"
+}
+
+func printOutputs(outputs []string, err error) {
+	for _, output := range outputs {
+		fmt.Println("Output : " + output)
+	}
+	if err != nil {
+		color.Red(err.Error())
+		exit(1)
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// saveTokens keeps the tokens of a login or refresh in the config file
+func saveTokens(token Token) error {
+	config.Values["auth.token"] = token.Data.Access
+	config.Values["auth.refresh"] = token.Data.Refresh
+	return config.Save()
 }
 
 func main() {
-	cleanUpFiles()
-	if len(os.Args) == 2 && os.Args[1] == "login" {
+	args := parseArgs(os.Args)
+	if err := loadConfig(); err != nil {
+		color.Red(err.Error())
+		os.Exit(1)
+	}
+	if len(args) >= 2 && args[1] == "config" {
+		if err := ConfigCommand(args[2:]); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) >= 2 && args[1] == "validate" {
+		if err := ValidateCommand(args[2:], flagSet("json")); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) >= 2 && args[1] == "library" && (len(args) < 3 || args[2] != "sync") {
+		if err := LibraryCommand(args[2:]); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) >= 2 && args[1] == "watch" && (len(args) < 3 || args[2] != "run") {
+		if err := WatchCommand(args[2:]); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) == 2 && args[1] == "serve" {
+		if err := Serve(); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) == 2 && args[1] == "daemon" {
+		if setting("auth.token", "") == "" {
+			color.Red("Please login first!")
+			os.Exit(1)
+		}
+		if err := Daemon(); err != nil {
+			color.Red(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) == 2 && args[1] == "login" {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Print("Username : ")
 		username, _ := reader.ReadString('\n')
 		username = strings.TrimSpace(username)
 		fmt.Print("Password : ")
 		password, _ := gopass.GetPasswdMasked()
-		resp := Login(username, string(password))
-
-		err := ioutil.WriteFile(
-			usr.HomeDir+"/.packt_config",
-			[]byte("TOKEN="+resp.Data.Access+"\r\nREFRESH="+resp.Data.Refresh),
-			0644)
+		resp, err := Login(username, string(password))
 		if err != nil {
+			color.Red("Login failed: " + err.Error())
+			os.Exit(1)
+		}
+
+		if err := saveTokens(resp); err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
 	}
 
-	if len(os.Args) < 3 {
+	if len(args) < 3 {
 		color.Red("Command error!\n")
-		fmt.Println("$ " + os.Args[0] + " <options> <arguments>\n")
-		fmt.Println("Available options:\n- login\n- search <keyword>\n- mobi <isbn>\n- epub <isbn>")
+		fmt.Println("$ " + args[0] + " <options> <arguments>\n")
+		fmt.Println("Available options:\n- login\n- config get <key> | set <key> <value> | list | edit\n- validate <file.epub> [--json]\n- library list | show <isbn> | rm <isbn> [format] [--delete-files] | verify | sync [isbn] [--dry-run] [--quick]\n- watch add <isbn> | list | rm <isbn> | log [isbn] | run [isbn]\n- serve [--listen :8080] [--title <name>]\n- daemon [--listen 127.0.0.1:8081] [--jobs 2] [--api-token <token>]\n- search <keyword>\n- get <isbn> [--format epub,pdf,...] [--output-dir <dir>] [--name-template \"{title}\"] [--on-conflict overwrite|skip|suffix] [--cover <image>] [--force] [--calibre-library <dir>]\n- <format> <isbn>\n- code <isbn> [--out <dir>]\n- export <isbn> [--format markdown|html] [--out <dir>]")
+		fmt.Println("\nFormats: " + strings.Join(WriterNames(), ", "))
 		return
 	}
 
-	if _, err := os.Stat(usr.HomeDir + "/.packt_tmp"); err == nil {
-		os.Mkdir(usr.HomeDir+"/.packt_tmp", 0744)
-	}
-
-	if _, err := os.Stat(usr.HomeDir + "/.packt_config"); err == nil {
-		godotenv.Load(usr.HomeDir + "/.packt_config")
-	} else {
+	if setting("auth.token", "") == "" {
 		color.Red("Please login first!")
 		os.Exit(1)
 	}
 
-	oToken := RefreshToken()
+	oToken, err := RefreshToken()
+	if err != nil {
+		color.Red("Token refresh failed: " + err.Error())
+		os.Exit(1)
+	}
 	if len(oToken.Data.Access) > 0 {
-		ioutil.WriteFile(
-			usr.HomeDir+"/.packt_config",
-			[]byte("TOKEN="+oToken.Data.Access+"\r\nREFRESH="+oToken.Data.Refresh),
-			0644)
+		if err := saveTokens(oToken); err != nil {
+			color.Red(err.Error())
+		}
 	}
 
-	switch opt := os.Args[1]; opt {
+	if err := setupWorkspace(); err != nil {
+		color.Red(err.Error())
+		os.Exit(1)
+	}
+	// runs on panics too, errors leave through exit
+	defer cleanupWorkspace()
+
+	switch opt := args[1]; opt {
 
 	case "search":
-		searchResult := Search(os.Args[2])
+		searchResult, err := Search(args[2])
+		if err != nil {
+			color.Red("Search failed: " + err.Error())
+			exit(1)
+		}
+		if len(searchResult.Results) == 0 {
+			color.Red("Search failed: no results returned")
+			exit(1)
+		}
 		color.Blue("Results:")
 		for _, item := range searchResult.Results[0].Hits {
 			fmt.Println(item.PrintIsbn13 + " - " + item.PublishedYear + " - " + item.Title)
 		}
-	case "mobi":
-		fileName := DownloadAsMobi(oToken.Data.Access, os.Args[2])
-		fmt.Println("Output : " + fileName + ".mobi")
-	case "epub":
-		fileName := DownloadAsEpub(oToken.Data.Access, os.Args[2])
-		fmt.Println("Output : " + fileName + ".epub")
+	case "get":
+		formats, err := parseFormats(flagValue("format", setting("default_format", "epub")))
+		if err != nil {
+			color.Red(err.Error())
+			exit(1)
+		}
+		printOutputs(DownloadBook(oToken.Data.Access, args[2], formats))
+	case "export":
+		// export predates get and names the static site "html"
+		format := flagValue("format", "markdown")
+		if format == "html" {
+			format = "site"
+		}
+		formats, err := parseFormats(format)
+		if err != nil {
+			color.Red(err.Error())
+			exit(1)
+		}
+		printOutputs(DownloadBook(oToken.Data.Access, args[2], formats))
+	case "library":
+		if err := SyncLibrary(oToken.Data.Access, args[3:]); err != nil {
+			color.Red(err.Error())
+			exit(1)
+		}
+	case "watch":
+		if err := WatchRun(oToken.Data.Access, args[3:]); err != nil {
+			color.Red(err.Error())
+			exit(1)
+		}
+	case "code":
+		outDir := flagValue("out", args[2])
+		listings, err := ExtractCode(oToken.Data.Access, args[2], outDir)
+		if err != nil {
+			color.Red(err.Error())
+			exit(1)
+		}
+		count := 0
+		for _, chapter := range listings {
+			count += len(chapter)
+		}
+		fmt.Printf("Output : %s (%d listings)\n", outDir, count)
+	default:
+		if _, ok := writers[opt]; !ok {
+			color.Red("Unknown option " + opt)
+			exit(1)
+		}
+		printOutputs(DownloadBook(oToken.Data.Access, args[2], []string{opt}))
 	}
-	removeTmpFiles()
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/xml"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	spaceRe      = regexp.MustCompile(`\s+`)
+	mdEscaper    = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`)
+	cellEscaper  = strings.NewReplacer("|", `\|`, "\n", " ")
+	headingLevel = map[string]int{"h1": 1, "h2": 2, "h3": 3, "h4": 4, "h5": 5, "h6": 6}
+	mdBlocks     = map[string]bool{
+		"p": true, "div": true, "section": true, "article": true, "figure": true,
+		"figcaption": true, "dt": true, "dd": true, "dl": true, "aside": true,
+	}
+)
+
+// mdConverter turns the xhtml of a section into Markdown
+type mdConverter struct {
+	out     strings.Builder
+	text    strings.Builder
+	quote   int
+	quoted  int
+	lists   []int
+	item    string
+	heading int
+	code    int
+	links   []string
+	pre     *strings.Builder
+	lang    string
+	table   [][]string
+	cell    *strings.Builder
+	stack   []bool
+	skip    int
+}
+
+func attrValue(t xml.StartElement, name string) string {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func (c *mdConverter) inline(s string) {
+	if c.cell != nil {
+		c.cell.WriteString(s)
+		return
+	}
+	c.text.WriteString(s)
+}
+
+// emit writes a block, prefixed for the blockquotes and list items it is in
+func (c *mdConverter) emit(block string) {
+	base := ""
+	if n := len(c.lists); n > 0 {
+		base = strings.Repeat("   ", n-1)
+	}
+	first, rest := base, base
+	if len(c.lists) > 0 {
+		first, rest = base+"   ", base+"   "
+	}
+	if c.item != "" {
+		first = base + c.item
+		c.item = ""
+	}
+	if c.out.Len() > 0 {
+		// blocks of one blockquote stay joined by a quoted blank line
+		shared := c.quote
+		if c.quoted < shared {
+			shared = c.quoted
+		}
+		c.out.WriteString(strings.TrimRight(strings.Repeat("> ", shared), " ") + "\n")
+	}
+	c.quoted = c.quote
+	quote := strings.Repeat("> ", c.quote)
+	for i, line := range strings.Split(block, "\n") {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if line == "" {
+			c.out.WriteString(strings.TrimRight(quote+prefix, " ") + "\n")
+			continue
+		}
+		c.out.WriteString(quote + prefix + line + "\n")
+	}
+}
+
+func (c *mdConverter) flush() {
+	text := strings.TrimSpace(c.text.String())
+	c.text.Reset()
+	if text == "" {
+		return
+	}
+	if c.heading > 0 {
+		text = strings.Repeat("#", c.heading) + " " + strings.Replace(text, "  \n", " ", -1)
+	}
+	c.emit(text)
+}
+
+func (c *mdConverter) renderTable() {
+	rows := c.table
+	c.table = nil
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	if columns == 0 {
+		return
+	}
+	var b strings.Builder
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString(strings.Repeat("| --- ", columns) + "|\n")
+		}
+	}
+	c.emit(strings.TrimRight(b.String(), "\n"))
+}
+
+func (c *mdConverter) start(t xml.StartElement) {
+	name := strings.ToLower(t.Name.Local)
+	class := attrValue(t, "class")
+	skipping := name == "script" || name == "style" || (c.pre != nil && (class == "ln" || class == "lnt"))
+	c.stack = append(c.stack, skipping)
+	if skipping {
+		c.skip++
+		return
+	}
+
+	switch {
+	case c.pre != nil:
+		if name == "br" {
+			c.pre.WriteString("\n")
+		}
+	case headingLevel[name] > 0:
+		c.flush()
+		c.heading = headingLevel[name]
+	case mdBlocks[name]:
+		c.flush()
+	case name == "pre":
+		c.flush()
+		c.pre = &strings.Builder{}
+		c.lang = codeLanguage(attrValue(t, "class") + ` data-code-language="` + attrValue(t, "data-code-language") + `"`)
+	case name == "ul" || name == "ol":
+		c.flush()
+		counter := -1
+		if name == "ol" {
+			counter = 0
+		}
+		c.lists = append(c.lists, counter)
+	case name == "li":
+		c.flush()
+		c.item = "- "
+		if n := len(c.lists); n > 0 && c.lists[n-1] >= 0 {
+			c.lists[n-1]++
+			c.item = strconv.Itoa(c.lists[n-1]) + ". "
+		}
+	case name == "blockquote":
+		c.flush()
+		c.quote++
+	case name == "hr":
+		c.flush()
+		c.emit("---")
+	case name == "table":
+		c.flush()
+		c.table = [][]string{}
+	case name == "tr":
+		c.table = append(c.table, []string{})
+	case name == "td" || name == "th":
+		c.cell = &strings.Builder{}
+	case name == "br":
+		c.inline("  \n")
+	case name == "b" || name == "strong":
+		c.inline("**")
+	case name == "i" || name == "em":
+		c.inline("*")
+	case name == "code" || name == "kbd" || name == "samp" || name == "tt":
+		c.code++
+		c.inline("`")
+	case name == "a":
+		href := attrValue(t, "href")
+		if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+			href = ""
+		}
+		if href != "" {
+			c.inline("[")
+		}
+		c.links = append(c.links, href)
+	case name == "img":
+		c.inline("![" + mdEscaper.Replace(attrValue(t, "alt")) + "](" + attrValue(t, "src") + ")")
+	}
+}
+
+func (c *mdConverter) end(t xml.EndElement) {
+	name := strings.ToLower(t.Name.Local)
+	skipping := false
+	if n := len(c.stack); n > 0 {
+		skipping = c.stack[n-1]
+		c.stack = c.stack[:n-1]
+	}
+	if skipping {
+		c.skip--
+		return
+	}
+
+	switch {
+	case name == "pre":
+		if c.pre != nil {
+			listing := strings.Trim(c.pre.String(), "\r\n")
+			c.pre = nil
+			c.emit("```" + c.lang + "\n" + listing + "\n```")
+		}
+	case c.pre != nil:
+	case headingLevel[name] > 0:
+		c.flush()
+		c.heading = 0
+	case mdBlocks[name]:
+		c.flush()
+	case name == "ul" || name == "ol":
+		c.flush()
+		if len(c.lists) > 0 {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+	case name == "li":
+		c.flush()
+		c.item = ""
+	case name == "blockquote":
+		c.flush()
+		c.quote--
+	case name == "table":
+		c.renderTable()
+	case name == "td" || name == "th":
+		if c.cell != nil && len(c.table) > 0 {
+			row := len(c.table) - 1
+			value := cellEscaper.Replace(strings.TrimSpace(c.cell.String()))
+			c.table[row] = append(c.table[row], value)
+		}
+		c.cell = nil
+	case name == "b" || name == "strong":
+		c.inline("**")
+	case name == "i" || name == "em":
+		c.inline("*")
+	case name == "code" || name == "kbd" || name == "samp" || name == "tt":
+		c.code--
+		c.inline("`")
+	case name == "a":
+		if n := len(c.links); n > 0 {
+			if href := c.links[n-1]; href != "" {
+				c.inline("](" + href + ")")
+			}
+			c.links = c.links[:n-1]
+		}
+	}
+}
+
+func (c *mdConverter) chars(s string) {
+	if c.skip > 0 {
+		return
+	}
+	if c.pre != nil {
+		c.pre.WriteString(s)
+		return
+	}
+	s = spaceRe.ReplaceAllString(s, " ")
+	if c.code == 0 {
+		s = mdEscaper.Replace(s)
+	}
+	c.inline(s)
+}
+
+// HtmlToMarkdown converts a section body to Markdown
+func HtmlToMarkdown(body string) string {
+	c := &mdConverter{}
+	d := xml.NewDecoder(strings.NewReader(cleanXHTML(body)))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			c.start(t)
+		case xml.EndElement:
+			c.end(t)
+		case xml.CharData:
+			c.chars(string(t))
+		}
+	}
+	c.flush()
+	return strings.TrimRight(c.out.String(), "\n") + "\n"
+}
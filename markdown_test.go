@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestHtmlToMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"heading and emphasis", `<h1>Title</h1><p>Some <b>bold</b> and <i>italic</i> text.</p>`, "# Title\n\nSome **bold** and *italic* text.\n"},
+		{"nested heading", `<h2 id="x">Sub <em>heading</em></h2>`, "## Sub *heading*\n"},
+		{"link and code", `<p>See <a href="https://example.com">the docs</a> and <code>go build</code>.</p>`, "See [the docs](https://example.com) and `go build`.\n"},
+		{"unordered list", `<ul><li>one</li><li>two</li></ul>`, "- one\n\n- two\n"},
+		{"ordered list", `<ol><li>first</li><li>second</li></ol>`, "1. first\n\n2. second\n"},
+		{"code block", "<pre class=\"programlisting language-go\"><code>func main() {\n\tx := 1\n}</code></pre>", "```go\nfunc main() {\n\tx := 1\n}\n```\n"},
+		{"code language attribute", `<pre class="source-code" data-code-language="python">print(1)</pre>`, "```python\nprint(1)\n```\n"},
+		{"escaped text", `<p>a * b_c [d] &lt;e&gt; &amp; f</p>`, "a \\* b\\_c \\[d\\] \\<e> & f\n"},
+		{"image", `<p><img src="../images/a.png" alt="Diagram"/></p>`, "![Diagram](../images/a.png)\n"},
+		{"table", `<table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td>2</td></tr></table>`, "| A | B |\n| --- | --- |\n| 1 | 2 |\n"},
+		{"quote", `<blockquote><p>quoted</p></blockquote>`, "> quoted\n"},
+	}
+	for _, tt := range tests {
+		if got := HtmlToMarkdown(tt.html); got != tt.want {
+			t.Errorf("%s: HtmlToMarkdown(%q) = %q, want %q", tt.name, tt.html, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// mathNode is an element of a MathML formula, text is the content of token
+// elements like mi, mn and mo
+type mathNode struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*mathNode
+}
+
+// parseMath reads a <math> element into a tree
+func parseMath(markup string) (*mathNode, error) {
+	d := xml.NewDecoder(strings.NewReader(markup))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	root := &mathNode{name: "root"}
+	stack := []*mathNode{root}
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			node := &mathNode{name: strings.ToLower(t.Name.Local), attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			top.children = append(top.children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.text += string(t)
+		}
+	}
+	if len(root.children) == 0 {
+		return nil, errors.New("no math element")
+	}
+	return root.children[0], nil
+}
+
+// group puts parentheses around a linearized operand longer than one symbol
+func group(s string) string {
+	s = strings.TrimSpace(s)
+	if len([]rune(s)) <= 1 || (strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")) {
+		return s
+	}
+	return "(" + s + ")"
+}
+
+// linear writes a formula on one line, a/b for fractions, x^2 and x_i for
+// scripts and √ for roots
+func (n *mathNode) linear() string {
+	arg := func(i int) string {
+		if i < len(n.children) {
+			return n.children[i].linear()
+		}
+		return ""
+	}
+	switch n.name {
+	case "mi", "mn", "mtext", "ms":
+		return strings.TrimSpace(n.text)
+	case "mo":
+		op := strings.TrimSpace(n.text)
+		switch op {
+		case "=", "+", "−", "-", "<", ">", "≤", "≥", "≠", "≈", "→", "×", "·", "∈":
+			return " " + op + " "
+		}
+		return op
+	case "mspace":
+		return " "
+	case "annotation", "annotation-xml":
+		return ""
+	case "semantics":
+		return arg(0)
+	case "mfrac":
+		return group(arg(0)) + "/" + group(arg(1))
+	case "msup":
+		return arg(0) + "^" + group(arg(1))
+	case "msub":
+		return arg(0) + "_" + group(arg(1))
+	case "msubsup":
+		return arg(0) + "_" + group(arg(1)) + "^" + group(arg(2))
+	case "munder":
+		return arg(0) + "_" + group(arg(1))
+	case "mover":
+		return arg(0) + "^" + group(arg(1))
+	case "munderover":
+		return arg(0) + "_" + group(arg(1)) + "^" + group(arg(2))
+	case "msqrt":
+		return "√" + group(n.joined(""))
+	case "mroot":
+		return group(arg(1)) + "√" + group(arg(0))
+	case "mfenced":
+		open, close, sep := "(", ")", ","
+		if v, ok := n.attrs["open"]; ok {
+			open = v
+		}
+		if v, ok := n.attrs["close"]; ok {
+			close = v
+		}
+		if v, ok := n.attrs["separators"]; ok {
+			sep = v
+		}
+		return open + n.joined(sep) + close
+	case "mtable":
+		return "[" + n.joined("; ") + "]"
+	case "mtr", "mlabeledtr":
+		return n.joined(", ")
+	}
+	return n.joined("")
+}
+
+func (n *mathNode) joined(sep string) string {
+	parts := make([]string, len(n.children))
+	for i, child := range n.children {
+		parts[i] = child.linear()
+	}
+	return strings.Join(parts, sep)
+}
+
+// MathText returns a formula as plain text, the alttext of the formula is
+// used when the MathML cannot be read
+func MathText(markup string) string {
+	root, err := parseMath(markup)
+	if err != nil {
+		return strings.Join(strings.Fields(tagRe.ReplaceAllString(markup, " ")), " ")
+	}
+	text := strings.Join(strings.Fields(root.linear()), " ")
+	if text == "" {
+		text = root.attrs["alttext"]
+	}
+	return text
+}
+
+// mathEm is the font size in pixels formulas are rendered at
+const mathEm = 48
+
+var (
+	rasterFontsOnce sync.Once
+	rasterFonts     map[string]*sfnt.Font
+)
+
+// rasterFont returns one of the Go fonts, they are shared by all renderers
+func rasterFont(name string) *sfnt.Font {
+	rasterFontsOnce.Do(func() {
+		rasterFonts = map[string]*sfnt.Font{}
+		for name, ttf := range map[string][]byte{
+			"regular": goregular.TTF, "italic": goitalic.TTF, "bold": gobold.TTF, "mono": gomono.TTF,
+		} {
+			f, err := opentype.Parse(ttf)
+			if err != nil {
+				panic(err)
+			}
+			rasterFonts[name] = f
+		}
+	})
+	return rasterFonts[name]
+}
+
+type faceKey struct {
+	font string
+	size float64
+}
+
+// typesetter keeps the font faces of one image, faces cannot be shared
+// between goroutines
+type typesetter struct {
+	faces map[faceKey]font.Face
+	buf   sfnt.Buffer
+}
+
+func newTypesetter() *typesetter {
+	return &typesetter{faces: map[faceKey]font.Face{}}
+}
+
+func (t *typesetter) face(name string, size float64) font.Face {
+	key := faceKey{name, size}
+	if face, ok := t.faces[key]; ok {
+		return face
+	}
+	face, err := opentype.NewFace(rasterFont(name), &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingNone})
+	if err != nil {
+		panic(err)
+	}
+	t.faces[key] = face
+	return face
+}
+
+// missing returns the first character of s the font has no glyph for
+func (t *typesetter) missing(name string, s string) rune {
+	for _, r := range s {
+		if r == ' ' {
+			continue
+		}
+		if i, err := rasterFont(name).GlyphIndex(&t.buf, r); err != nil || i == 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+func toFixed(v float64) fixed.Int26_6 {
+	return fixed.Int26_6(math.Round(v * 64))
+}
+
+func fromFixed(v fixed.Int26_6) float64 {
+	return float64(v) / 64
+}
+
+// mathBox is a laid out part of a formula, ascent and descent are measured
+// from the baseline, draw paints it with the baseline at y
+type mathBox struct {
+	width, ascent, descent float64
+	draw                   func(dst *image.RGBA, x, y float64)
+}
+
+func (t *typesetter) text(s string, fontName string, size float64) (*mathBox, error) {
+	if r := t.missing(fontName, s); r != 0 {
+		return nil, fmt.Errorf("no glyph for %q", r)
+	}
+	face := t.face(fontName, size)
+	bounds, advance := font.BoundString(face, s)
+	return &mathBox{
+		width:   math.Max(fromFixed(advance), fromFixed(bounds.Max.X)),
+		ascent:  math.Max(-fromFixed(bounds.Min.Y), 0),
+		descent: math.Max(fromFixed(bounds.Max.Y), 0),
+		draw: func(dst *image.RGBA, x, y float64) {
+			d := font.Drawer{Dst: dst, Src: image.Black, Face: face, Dot: fixed.Point26_6{X: toFixed(x), Y: toFixed(y)}}
+			d.DrawString(s)
+		},
+	}, nil
+}
+
+// hbox puts boxes next to each other on the baseline
+func hbox(boxes ...*mathBox) *mathBox {
+	row := &mathBox{}
+	for _, b := range boxes {
+		row.width += b.width
+		row.ascent = math.Max(row.ascent, b.ascent)
+		row.descent = math.Max(row.descent, b.descent)
+	}
+	row.draw = func(dst *image.RGBA, x, y float64) {
+		for _, b := range boxes {
+			b.draw(dst, x, y)
+			x += b.width
+		}
+	}
+	return row
+}
+
+// raise moves a box up by dy, down when dy is negative
+func raise(b *mathBox, dy float64) *mathBox {
+	return &mathBox{
+		width:   b.width,
+		ascent:  b.ascent + dy,
+		descent: b.descent - dy,
+		draw:    func(dst *image.RGBA, x, y float64) { b.draw(dst, x, y-dy) },
+	}
+}
+
+// pad adds space left and right of a box
+func pad(b *mathBox, left float64, right float64) *mathBox {
+	return &mathBox{
+		width:   left + b.width + right,
+		ascent:  b.ascent,
+		descent: b.descent,
+		draw:    func(dst *image.RGBA, x, y float64) { b.draw(dst, x+left, y) },
+	}
+}
+
+func space(width float64) *mathBox {
+	return &mathBox{width: width, draw: func(*image.RGBA, float64, float64) {}}
+}
+
+// rule fills a rectangle, used for fraction bars and the roof of roots
+func rule(dst *image.RGBA, x0, y0, x1, y1 float64) {
+	r := image.Rect(int(math.Round(x0)), int(math.Round(y0)), int(math.Round(x1)), int(math.Round(y1)))
+	if r.Dy() == 0 {
+		r.Max.Y++
+	}
+	draw.Draw(dst, r, image.Black, image.Point{}, draw.Over)
+}
+
+// stroke draws a polyline of the given width
+func stroke(dst *image.RGBA, width float64, points ...float64) {
+	size := dst.Bounds().Size()
+	scanner := rasterx.NewScannerGV(size.X, size.Y, dst, dst.Bounds())
+	scanner.SetColor(image.Black)
+	s := rasterx.NewStroker(size.X, size.Y, scanner)
+	s.SetStroke(toFixed(width), toFixed(4), rasterx.ButtCap, nil, nil, rasterx.Miter)
+	s.Start(fixed.Point26_6{X: toFixed(points[0]), Y: toFixed(points[1])})
+	for i := 2; i+1 < len(points); i += 2 {
+		s.Line(fixed.Point26_6{X: toFixed(points[i]), Y: toFixed(points[i+1])})
+	}
+	s.Stop(false)
+	s.Draw()
+}
+
+var (
+	relations = "=<>≤≥≠≈≡∼≃≅∝→←↔⇒⇐⇔∈∉⊂⊃⊆⊇:"
+	binaries  = "+−-×·÷±∓∗∘∧∨∩∪⊕⊗"
+	fences    = "()[]{}|‖⟨⟩⌈⌉⌊⌋"
+	largeOps  = "∑∏∐∫∬∭∮⋃⋂⋀⋁"
+)
+
+func isOperator(n *mathNode, set string) bool {
+	op := strings.TrimSpace(n.text)
+	return n.name == "mo" && op != "" && len(n.children) == 0 && strings.Contains(set, op) && len([]rune(op)) == 1
+}
+
+// scriptSize is the size of sub and superscripts, limits and fractions in
+// running text
+func scriptSize(size float64) float64 {
+	return math.Max(size*0.71, mathEm*0.5)
+}
+
+// emLength reads a MathML length like 0.5em or 3px
+func emLength(v string, size float64, fallback float64) float64 {
+	v = strings.TrimSpace(v)
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(v, "em"):
+		v, unit = strings.TrimSuffix(v, "em"), size
+	case strings.HasSuffix(v, "ex"):
+		v, unit = strings.TrimSuffix(v, "ex"), size/2
+	case strings.HasSuffix(v, "px"):
+		v = strings.TrimSuffix(v, "px")
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f * unit
+}
+
+// layout typesets a MathML element, display is set for formulas shown as a
+// block, their fractions and large operators are not shrunk
+func (t *typesetter) layout(n *mathNode, size float64, display bool) (*mathBox, error) {
+	arg := func(i int, size float64, display bool) (*mathBox, error) {
+		if i >= len(n.children) {
+			return space(0), nil
+		}
+		return t.layout(n.children[i], size, display)
+	}
+	axis := size * 0.25
+	thick := math.Max(1, size/18)
+
+	switch n.name {
+	case "mi":
+		s := strings.TrimSpace(n.text)
+		variant := n.attrs["mathvariant"]
+		switch {
+		case strings.Contains(variant, "bold"):
+			return t.text(s, "bold", size)
+		case variant == "monospace":
+			return t.text(s, "mono", size)
+		case len([]rune(s)) == 1 && variant != "normal":
+			return t.text(s, "italic", size)
+		}
+		return t.text(s, "regular", size)
+	case "mn", "mtext", "ms":
+		return t.text(strings.TrimSpace(n.text), "regular", size)
+	case "mo":
+		op := strings.TrimSpace(n.text)
+		if isOperator(n, largeOps) {
+			scale := 1.2
+			if display {
+				scale = 1.6
+			}
+			b, err := t.text(op, "regular", size*scale)
+			if err != nil {
+				return nil, err
+			}
+			return pad(raise(b, axis-(b.ascent-b.descent)/2), size*0.1, size*0.1), nil
+		}
+		b, err := t.text(op, "regular", size)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case isOperator(n, relations):
+			return pad(b, size*0.28, size*0.28), nil
+		case isOperator(n, binaries):
+			return pad(b, size*0.22, size*0.22), nil
+		case op == "," || op == ";":
+			return pad(b, 0, size*0.17), nil
+		}
+		return b, nil
+	case "mspace":
+		return space(emLength(n.attrs["width"], size, size*0.17)), nil
+	case "annotation", "annotation-xml", "none", "mprescripts":
+		return space(0), nil
+	case "semantics":
+		return arg(0, size, display)
+	case "mstyle":
+		switch n.attrs["displaystyle"] {
+		case "true":
+			display = true
+		case "false":
+			display = false
+		}
+		return t.row(n.children, size, display)
+	case "mphantom":
+		b, err := t.row(n.children, size, display)
+		if err != nil {
+			return nil, err
+		}
+		return &mathBox{width: b.width, ascent: b.ascent, descent: b.descent, draw: func(*image.RGBA, float64, float64) {}}, nil
+	case "mfrac":
+		part := size
+		if !display {
+			part = scriptSize(size)
+		}
+		num, err := arg(0, part, false)
+		if err != nil {
+			return nil, err
+		}
+		den, err := arg(1, part, false)
+		if err != nil {
+			return nil, err
+		}
+		bar := thick
+		if emLength(n.attrs["linethickness"], size, 1) == 0 {
+			bar = 0
+		}
+		gap := size * 0.12
+		width := math.Max(num.width, den.width) + size*0.2
+		numBase := axis + bar/2 + gap + num.descent
+		denBase := den.ascent + gap + bar/2 - axis
+		return &mathBox{
+			width:   width + size*0.1,
+			ascent:  numBase + num.ascent,
+			descent: math.Max(denBase+den.descent, 0),
+			draw: func(dst *image.RGBA, x, y float64) {
+				x += size * 0.05
+				num.draw(dst, x+(width-num.width)/2, y-numBase)
+				den.draw(dst, x+(width-den.width)/2, y+denBase)
+				if bar > 0 {
+					rule(dst, x, y-axis-bar/2, x+width, y-axis+bar/2)
+				}
+			},
+		}, nil
+	case "msqrt", "mroot":
+		var inner, index *mathBox
+		var err error
+		if n.name == "msqrt" {
+			inner, err = t.row(n.children, size, display)
+		} else {
+			inner, err = arg(0, size, display)
+			if err == nil {
+				index, err = arg(1, scriptSize(scriptSize(size)), false)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		gap := size * 0.12
+		sign := size * 0.55
+		lead := 0.0
+		if index != nil {
+			lead = math.Max(index.width-sign*0.45, 0)
+		}
+		ascent := math.Max(inner.ascent, size*0.5) + gap + thick
+		descent := math.Max(inner.descent, size*0.1)
+		// the index sits on the upper half of the tick
+		indexRaise := 0.0
+		if index != nil {
+			indexRaise = (ascent+descent-thick/2)*0.5 - descent + index.descent
+		}
+		b := &mathBox{
+			width:   lead + sign + inner.width + size*0.1,
+			ascent:  ascent,
+			descent: descent,
+			draw: func(dst *image.RGBA, x, y float64) {
+				top, bottom := y-ascent+thick/2, y+descent
+				x += lead
+				stroke(dst, thick, x, bottom-(bottom-top)*0.4, x+sign*0.25, bottom-(bottom-top)*0.45,
+					x+sign*0.5, bottom, x+sign, top, x+sign+inner.width+size*0.1, top)
+				inner.draw(dst, x+sign, y)
+				if index != nil {
+					index.draw(dst, x+sign*0.45-index.width, y-indexRaise)
+				}
+			},
+		}
+		if index != nil {
+			b.ascent = math.Max(b.ascent, indexRaise+index.ascent)
+		}
+		return b, nil
+	case "msup", "msub", "msubsup", "mmultiscripts":
+		base, err := arg(0, size, display)
+		if err != nil {
+			return nil, err
+		}
+		script := scriptSize(size)
+		var sub, sup *mathBox
+		switch n.name {
+		case "msup":
+			sup, err = arg(1, script, false)
+		case "msub":
+			sub, err = arg(1, script, false)
+		default:
+			if sub, err = arg(1, script, false); err == nil {
+				sup, err = arg(2, script, false)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return t.scripts(base, sub, sup, size), nil
+	case "munder", "mover", "munderover":
+		base, err := arg(0, size, display)
+		if err != nil {
+			return nil, err
+		}
+		script := scriptSize(size)
+		var under, over *mathBox
+		switch n.name {
+		case "munder":
+			under, err = arg(1, script, false)
+		case "mover":
+			over, err = arg(1, script, false)
+		default:
+			if under, err = arg(1, script, false); err == nil {
+				over, err = arg(2, script, false)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		// limits of large operators in running text go to the side
+		if !display && len(n.children) > 0 && isOperator(n.children[0], largeOps) {
+			return t.scripts(base, under, over, size), nil
+		}
+		return limits(base, under, over, size), nil
+	case "mfenced":
+		open, close, seps := "(", ")", ","
+		if v, ok := n.attrs["open"]; ok {
+			open = v
+		}
+		if v, ok := n.attrs["close"]; ok {
+			close = v
+		}
+		if v, ok := n.attrs["separators"]; ok {
+			seps = strings.Join(strings.Fields(v), "")
+		}
+		sepRunes := []rune(seps)
+		nodes := []*mathNode{{name: "mo", text: open}}
+		for i, child := range n.children {
+			if i > 0 && len(sepRunes) > 0 {
+				nodes = append(nodes, &mathNode{name: "mo", text: string(sepRunes[min(i-1, len(sepRunes)-1)])})
+			}
+			nodes = append(nodes, child)
+		}
+		nodes = append(nodes, &mathNode{name: "mo", text: close})
+		return t.row(nodes, size, display)
+	case "mtable":
+		return t.table(n, size)
+	}
+	return t.row(n.children, size, display)
+}
+
+// scripts attaches sub and superscripts, either may be nil
+func (t *typesetter) scripts(base *mathBox, sub *mathBox, sup *mathBox, size float64) *mathBox {
+	width := 0.0
+	var supShift, subShift float64
+	if sup != nil {
+		supShift = math.Max(base.ascent-size*0.3, size*0.35)
+		supShift = math.Max(supShift, sup.descent+size*0.25)
+		width = sup.width
+	}
+	if sub != nil {
+		subShift = math.Max(base.descent+size*0.05, size*0.2)
+		subShift = math.Max(subShift, sub.ascent-size*0.4)
+		width = math.Max(width, sub.width)
+	}
+	if sup != nil && sub != nil {
+		// keep a gap between the two scripts
+		if overlap := (sub.ascent - subShift) - (supShift - sup.descent) + size*0.1; overlap > 0 {
+			supShift += overlap / 2
+			subShift += overlap / 2
+		}
+	}
+	b := &mathBox{width: base.width + width + size*0.05, ascent: base.ascent, descent: base.descent}
+	if sup != nil {
+		b.ascent = math.Max(b.ascent, supShift+sup.ascent)
+	}
+	if sub != nil {
+		b.descent = math.Max(b.descent, subShift+sub.descent)
+	}
+	b.draw = func(dst *image.RGBA, x, y float64) {
+		base.draw(dst, x, y)
+		if sup != nil {
+			sup.draw(dst, x+base.width+size*0.02, y-supShift)
+		}
+		if sub != nil {
+			sub.draw(dst, x+base.width, y+subShift)
+		}
+	}
+	return b
+}
+
+// limits stacks under and over scripts centered on the base
+func limits(base *mathBox, under *mathBox, over *mathBox, size float64) *mathBox {
+	gap := size * 0.1
+	width := base.width
+	b := &mathBox{ascent: base.ascent, descent: base.descent}
+	if over != nil {
+		width = math.Max(width, over.width)
+		b.ascent += gap + over.descent + over.ascent
+	}
+	if under != nil {
+		width = math.Max(width, under.width)
+		b.descent += gap + under.ascent + under.descent
+	}
+	b.width = width
+	b.draw = func(dst *image.RGBA, x, y float64) {
+		base.draw(dst, x+(width-base.width)/2, y)
+		if over != nil {
+			over.draw(dst, x+(width-over.width)/2, y-base.ascent-gap-over.descent)
+		}
+		if under != nil {
+			under.draw(dst, x+(width-under.width)/2, y+base.descent+gap+under.ascent)
+		}
+	}
+	return b
+}
+
+// row lays out elements next to each other, fences around something taller
+// than a line grow to the height of what they enclose
+func (t *typesetter) row(nodes []*mathNode, size float64, display bool) (*mathBox, error) {
+	boxes := make([]*mathBox, len(nodes))
+	for i, n := range nodes {
+		b, err := t.layout(n, size, display)
+		if err != nil {
+			return nil, err
+		}
+		// a sign at the start or after another operator is not a binary one
+		if isOperator(n, binaries) && (i == 0 || nodes[i-1].name == "mo") {
+			if b, err = t.text(strings.TrimSpace(n.text), "regular", size); err != nil {
+				return nil, err
+			}
+		}
+		boxes[i] = b
+	}
+
+	// extents of the content between each pair of fences, fences without a
+	// partner take the extents of the whole row
+	type extent struct {
+		fence           int
+		ascent, descent float64
+	}
+	var row extent
+	var open []extent
+	heights := map[int]extent{}
+	for i, n := range nodes {
+		if !isOperator(n, fences) {
+			if len(open) > 0 {
+				top := &open[len(open)-1]
+				top.ascent = math.Max(top.ascent, boxes[i].ascent)
+				top.descent = math.Max(top.descent, boxes[i].descent)
+			}
+			row.ascent = math.Max(row.ascent, boxes[i].ascent)
+			row.descent = math.Max(row.descent, boxes[i].descent)
+			continue
+		}
+		op := strings.TrimSpace(n.text)
+		closing := strings.Contains(")]}⟩⌉⌋", op) ||
+			(strings.Contains("|‖", op) && len(open) > 0 && strings.TrimSpace(nodes[open[len(open)-1].fence].text) == op)
+		if !closing {
+			open = append(open, extent{fence: i})
+			continue
+		}
+		if len(open) == 0 {
+			continue
+		}
+		inner := open[len(open)-1]
+		open = open[:len(open)-1]
+		heights[inner.fence], heights[i] = inner, inner
+		if len(open) > 0 {
+			top := &open[len(open)-1]
+			top.ascent = math.Max(top.ascent, inner.ascent)
+			top.descent = math.Max(top.descent, inner.descent)
+		}
+	}
+	for i, n := range nodes {
+		if !isOperator(n, fences) {
+			continue
+		}
+		e, ok := heights[i]
+		if !ok {
+			e = row
+		}
+		if e.ascent+e.descent <= size*1.3 {
+			continue
+		}
+		b, err := t.fence(strings.TrimSpace(n.text), size, e.ascent, e.descent)
+		if err != nil {
+			return nil, err
+		}
+		boxes[i] = b
+	}
+	return hbox(boxes...), nil
+}
+
+// fence scales a parenthesis or bracket to reach from descent below to
+// ascent above the baseline
+func (t *typesetter) fence(s string, size float64, ascent float64, descent float64) (*mathBox, error) {
+	b, err := t.text(s, "regular", size)
+	if err != nil {
+		return nil, err
+	}
+	if h := b.ascent + b.descent; h > 0 {
+		if b, err = t.text(s, "regular", size*(ascent+descent)/h); err != nil {
+			return nil, err
+		}
+	}
+	return raise(b, (ascent-descent)/2-(b.ascent-b.descent)/2), nil
+}
+
+// table lays out matrices and aligned equations, centered on the math axis
+func (t *typesetter) table(n *mathNode, size float64) (*mathBox, error) {
+	var cells [][]*mathBox
+	var widths []float64
+	for _, tr := range n.children {
+		var row []*mathBox
+		for _, td := range tr.children {
+			b, err := t.row(td.children, size, false)
+			if err != nil {
+				return nil, err
+			}
+			if len(row) == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[len(row)] = math.Max(widths[len(row)], b.width)
+			row = append(row, b)
+		}
+		cells = append(cells, row)
+	}
+	colGap, rowGap := size*0.8, size*0.3
+	ascents := make([]float64, len(cells))
+	descents := make([]float64, len(cells))
+	height, width := 0.0, 0.0
+	for i, row := range cells {
+		ascents[i], descents[i] = size*0.7, size*0.2
+		for _, b := range row {
+			ascents[i] = math.Max(ascents[i], b.ascent)
+			descents[i] = math.Max(descents[i], b.descent)
+		}
+		height += ascents[i] + descents[i]
+		if i > 0 {
+			height += rowGap
+		}
+	}
+	for i, w := range widths {
+		width += w
+		if i > 0 {
+			width += colGap
+		}
+	}
+	axis := size * 0.25
+	return &mathBox{
+		width:   width + size*0.2,
+		ascent:  height/2 + axis,
+		descent: height/2 - axis,
+		draw: func(dst *image.RGBA, x, y float64) {
+			top := y - height/2 - axis
+			for i, row := range cells {
+				top += ascents[i]
+				cx := x + size*0.1
+				for j, b := range row {
+					b.draw(dst, cx+(widths[j]-b.width)/2, top)
+					cx += widths[j] + colGap
+				}
+				top += descents[i] + rowGap
+			}
+		},
+	}, nil
+}
+
+// MathImage is a formula rendered as PNG, height and depth are its size
+// above and below the baseline in em
+type MathImage struct {
+	PNG    []byte
+	Height float64
+	Depth  float64
+}
+
+// RenderMath typesets a MathML formula with the Go fonts, formulas using
+// characters the fonts do not have return an error
+func RenderMath(markup string) (*MathImage, error) {
+	root, err := parseMath(markup)
+	if err != nil {
+		return nil, err
+	}
+	t := newTypesetter()
+	b, err := t.layout(root, mathEm, root.attrs["display"] == "block")
+	if err != nil {
+		return nil, err
+	}
+	if b.width == 0 {
+		return nil, errors.New("empty formula")
+	}
+	const margin = 2
+	ascent := int(math.Ceil(b.ascent)) + margin
+	descent := int(math.Ceil(b.descent)) + margin
+	img := image.NewRGBA(image.Rect(0, 0, int(math.Ceil(b.width))+2*margin, ascent+descent))
+	b.draw(img, margin, float64(ascent))
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &MathImage{
+		PNG:    buf.Bytes(),
+		Height: float64(ascent+descent) / mathEm,
+		Depth:  float64(descent) / mathEm,
+	}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestRenderMath(t *testing.T) {
+	tests := []struct {
+		name    string
+		markup  string
+		taller  bool // than a line of text
+		wantErr bool
+	}{
+		{"identifier", `<math><mi>x</mi></math>`, false, false},
+		{"row", `<math><mi>a</mi><mo>+</mo><mn>1</mn></math>`, false, false},
+		{"fraction", `<math display="block"><mfrac><mi>a</mi><mi>b</mi></mfrac></math>`, true, false},
+		{"root of a fraction", `<math display="block"><msqrt><mfrac><mn>1</mn><mi>n</mi></mfrac></msqrt></math>`, true, false},
+		{"matrix", `<math><mfenced><mtable><mtr><mtd><mn>1</mn></mtd></mtr><mtr><mtd><mn>2</mn></mtd></mtr></mtable></mfenced></math>`, true, false},
+		{"missing glyph", `<math><mi>ℵ</mi></math>`, false, true},
+		{"empty", `<math></math>`, false, true},
+		{"not math", `plain text`, false, true},
+	}
+	for _, tt := range tests {
+		img, err := RenderMath(tt.markup)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if _, err := png.Decode(bytes.NewReader(img.PNG)); err != nil {
+			t.Errorf("%s: not a PNG: %v", tt.name, err)
+		}
+		if img.Depth <= 0 || img.Depth >= img.Height {
+			t.Errorf("%s: depth %.2f outside height %.2f", tt.name, img.Depth, img.Height)
+		}
+		if taller := img.Height > 1.5; taller != tt.taller {
+			t.Errorf("%s: height %.2fem, want taller than a line %v", tt.name, img.Height, tt.taller)
+		}
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	tests := []struct {
+		name      string
+		svg       string
+		wantWidth int
+		wantErr   bool
+	}{
+		{"view box", `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 50"><rect width="100" height="50"/></svg>`, 200, false},
+		{"width and height", `<svg xmlns="http://www.w3.org/2000/svg" width="30" height="20"><text x="2" y="15">A</text></svg>`, 60, false},
+		{"wide", `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 4000 100"></svg>`, svgMaxWidth, false},
+		{"no size", `<svg xmlns="http://www.w3.org/2000/svg"><circle r="5"/></svg>`, 0, true},
+	}
+	for _, tt := range tests {
+		data, err := RenderSVG([]byte(tt.svg))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: not a PNG: %v", tt.name, err)
+			continue
+		}
+		if w := img.Bounds().Dx(); w != tt.wantWidth {
+			t.Errorf("%s: width %d, want %d", tt.name, w, tt.wantWidth)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/cavaliercoder/grab"
+	"github.com/fatih/color"
+)
+
+var (
+	clientOnce   sync.Once
+	sharedClient *http.Client
+	clientErr    error
+)
+
+// proxyFunc picks the proxy from --proxy or the proxy setting, and from
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY otherwise
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	proxy := flagValue("proxy", "")
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// certPool adds the PEM bundles of --ca-bundle to the system roots, several
+// files are separated like $PATH
+func certPool() (*x509.CertPool, error) {
+	bundles := flagValue("ca-bundle", "")
+	if bundles == "" {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	for _, bundle := range filepath.SplitList(bundles) {
+		pem, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", bundle)
+		}
+	}
+	return pool, nil
+}
+
+func newHTTPClient() (*http.Client, error) {
+	proxy, err := proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := certPool()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	if pool != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// httpClient is the client every request goes through so the proxy and CA
+// settings apply everywhere
+func httpClient() *http.Client {
+	clientOnce.Do(func() {
+		sharedClient, clientErr = newHTTPClient()
+	})
+	if clientErr != nil {
+		color.Red(clientErr.Error())
+		exit(1)
+	}
+	return sharedClient
+}
+
+// grabFile downloads url to dst with the shared client
+func grabFile(dst string, url string) error {
+	client := grab.NewClient()
+	client.HTTPClient = httpClient()
+	req, err := grab.NewRequest(dst, url)
+	if err != nil {
+		return err
+	}
+	return client.Do(req).Err()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultNameTemplate = "{title}"
+
+// longest file name most filesystems accept, in bytes, minus room for a
+// collision suffix and the extension
+const maxNameLength = 200
+
+var (
+	templateFieldRe = regexp.MustCompile(`\{(\w+)\}`)
+	editionRe       = regexp.MustCompile(`(?i)\b(\w+)\s+edition\b`)
+	unsafeNameRe    = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]+`)
+	nameSpaceRe     = regexp.MustCompile(`\s+`)
+)
+
+// names Windows refuses whatever the extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// bookEdition reads the edition out of titles like "Mastering Go - Second Edition"
+func bookEdition(title string) string {
+	if m := editionRe.FindStringSubmatch(title); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// nameFields are the values a --name-template can use
+func nameFields(book *Book) map[string]string {
+	year := ""
+	if !book.Summary.PublicationDate.IsZero() {
+		year = strconv.Itoa(book.Summary.PublicationDate.Year())
+	}
+	return map[string]string{
+		"title":   book.Title,
+		"isbn":    book.Identifier,
+		"author":  book.Author,
+		"year":    year,
+		"edition": bookEdition(book.Title),
+	}
+}
+
+// expandTemplate fills the {field}s of a name template, unknown fields are
+// an error so typos do not end up in file names
+func expandTemplate(template string, fields map[string]string) (string, error) {
+	var err error
+	name := templateFieldRe.ReplaceAllStringFunc(template, func(field string) string {
+		value, ok := fields[field[1:len(field)-1]]
+		if !ok {
+			err = fmt.Errorf("unknown field %s in name template, use {title}, {isbn}, {author}, {year} or {edition}", field)
+		}
+		return value
+	})
+	return name, err
+}
+
+// SanitizeName makes a file name that is valid on Linux, macOS and Windows
+func SanitizeName(name string) string {
+	name = unsafeNameRe.ReplaceAllString(name, " - ")
+	name = nameSpaceRe.ReplaceAllString(name, " ")
+	name = strings.Trim(name, " .-")
+	for len(name) > maxNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	name = strings.TrimRight(name, " .")
+	if reservedNames[strings.ToUpper(name)] {
+		name = "_" + name
+	}
+	if name == "" {
+		name = "book"
+	}
+	return name
+}
+
+// OutputPath builds where a format of the book is written from --output-dir
+// and --name-template. It reports false when the file exists and the
+// --on-conflict policy says to skip it.
+func OutputPath(book *Book, ext string) (string, bool, error) {
+	name, err := expandTemplate(flagValue("name-template", defaultNameTemplate), nameFields(book))
+	if err != nil {
+		return "", false, err
+	}
+	dir := flagValue("output-dir", ".")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", false, err
+	}
+	return resolveConflict(filepath.Join(dir, SanitizeName(name)), ext)
+}
+
+func resolveConflict(base string, ext string) (string, bool, error) {
+	path := base + ext
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, true, nil
+	}
+	switch policy := flagValue("on-conflict", "overwrite"); policy {
+	case "overwrite":
+		return path, true, nil
+	case "skip":
+		return path, false, nil
+	case "suffix":
+		for i := 2; ; i++ {
+			path = fmt.Sprintf("%s (%d)%s", base, i, ext)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return path, true, nil
+			}
+		}
+	default:
+		return "", false, fmt.Errorf("unknown conflict policy %q, use skip, overwrite or suffix", policy)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Mastering Go", "Mastering Go"},
+		{"Go: The Complete Guide", "Go - The Complete Guide"},
+		{`a/b\c`, "a - b - c"},
+		{"What is Go?", "What is Go"},
+		{"  .hidden.  ", "hidden"},
+		{"tabs\tand\nnew lines", "tabs - and - new lines"},
+		{"CON", "_CON"},
+		{"lpt1", "_lpt1"},
+		{"", "book"},
+		{"???", "book"},
+		{strings.Repeat("é", 150), strings.Repeat("é", 100)},
+	}
+	for _, tt := range tests {
+		if got := SanitizeName(tt.name); got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	fields := map[string]string{"title": "Mastering Go", "isbn": "9781800207974", "author": "Mihalis Tsoukalos", "year": "2021", "edition": ""}
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"{title}", "Mastering Go", false},
+		{"{author} - {title} ({year})", "Mihalis Tsoukalos - Mastering Go (2021)", false},
+		{"{isbn}{edition}", "9781800207974", false},
+		{"no fields", "no fields", false},
+		{"{titel}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := expandTemplate(tt.template, fields)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandTemplate(%q) error = %v, want error %v", tt.template, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("expandTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "book")
+	for _, name := range []string{"book.epub", "book (2).epub"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer delete(flags, "on-conflict")
+
+	tests := []struct {
+		policy    string
+		ext       string
+		wantPath  string
+		wantWrite bool
+		wantErr   bool
+	}{
+		{"overwrite", ".pdf", base + ".pdf", true, false},
+		{"skip", ".pdf", base + ".pdf", true, false},
+		{"overwrite", ".epub", base + ".epub", true, false},
+		{"skip", ".epub", base + ".epub", false, false},
+		{"suffix", ".epub", base + " (3).epub", true, false},
+		{"rename", ".epub", "", false, true},
+	}
+	for _, tt := range tests {
+		flags["on-conflict"] = tt.policy
+		path, write, err := resolveConflict(base, tt.ext)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %s: error = %v, want error %v", tt.policy, tt.ext, err, tt.wantErr)
+			continue
+		}
+		if path != tt.wantPath || write != tt.wantWrite {
+			t.Errorf("%s %s: got %q, %v, want %q, %v", tt.policy, tt.ext, path, write, tt.wantPath, tt.wantWrite)
+		}
+	}
+}
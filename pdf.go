@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func init() {
+	RegisterWriter("pdf", writerFunc{".pdf", WritePdf})
+}
+
+// PageLayout is a page size in millimeters with its margin and base font size
+type PageLayout struct {
+	Width    float64
+	Height   float64
+	Margin   float64
+	FontSize float64
+}
+
+var pageLayouts = map[string]PageLayout{
+	"a4":     {Width: 210, Height: 297, Margin: 18, FontSize: 11},
+	"letter": {Width: 215.9, Height: 279.4, Margin: 18, FontSize: 11},
+	"6in":    {Width: 90, Height: 122, Margin: 6, FontSize: 9},
+}
+
+var headingScale = map[string]float64{
+	"h1": 1.8, "h2": 1.5, "h3": 1.3, "h4": 1.15, "h5": 1.05, "h6": 1,
+}
+
+var blockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "figure": true,
+	"figcaption": true, "li": true, "tr": true, "dt": true, "dd": true,
+	"dl": true, "table": true, "aside": true, "header": true, "footer": true,
+}
+
+// pdfRenderer lays the xhtml of the sections out on pdf pages
+type pdfRenderer struct {
+	pdf     *fpdf.Fpdf
+	layout  PageLayout
+	images  map[string]string
+	size    float64
+	bold    int
+	italic  int
+	mono    int
+	skip    int
+	indent  float64
+	lists   []int
+	cell    int
+	pre     *strings.Builder
+	pending bool
+}
+
+func (r *pdfRenderer) lineHeight() float64 {
+	return r.size * 0.5
+}
+
+func (r *pdfRenderer) setFont() {
+	family, style := "go", ""
+	if r.mono > 0 {
+		family = "gomono"
+	}
+	if r.bold > 0 {
+		style += "B"
+	}
+	if r.italic > 0 && r.mono == 0 {
+		style += "I"
+	}
+	r.pdf.SetFont(family, style, r.size)
+}
+
+// block ends the running line of text before a block element
+func (r *pdfRenderer) block() {
+	if r.pending {
+		r.pdf.Ln(r.lineHeight())
+		r.pending = false
+	}
+}
+
+func (r *pdfRenderer) setIndent(indent float64) {
+	r.indent = indent
+	r.pdf.SetLeftMargin(r.layout.Margin + indent)
+	r.pdf.SetX(r.layout.Margin + indent)
+}
+
+func (r *pdfRenderer) text(s string) {
+	if r.pre != nil {
+		r.pre.WriteString(s)
+		return
+	}
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		if r.pending {
+			r.pdf.Write(r.lineHeight(), " ")
+		}
+		return
+	}
+	r.pdf.Write(r.lineHeight(), s)
+	r.pending = true
+}
+
+func (r *pdfRenderer) code(listing string) {
+	r.block()
+	size := r.size
+	r.size = size * 0.85
+	r.mono++
+	r.setFont()
+	r.pdf.SetFillColor(238, 238, 238)
+	r.pdf.MultiCell(0, r.lineHeight(), strings.Trim(listing, "\r\n"), "", "L", true)
+	r.mono--
+	r.size = size
+	r.setFont()
+	r.pdf.Ln(r.lineHeight() / 2)
+}
+
+// pdfImage reads an image file and tells its type, the file names of covers
+// do not always have an extension so the content is sniffed
+func pdfImage(file string) ([]byte, string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, ""
+	}
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return data, "JPG"
+	case "image/png":
+		return data, "PNG"
+	case "image/gif":
+		return data, "GIF"
+	}
+	return nil, ""
+}
+
+// image places an image at the current position, scaled to the text width,
+// images that cannot be embedded like SVG are replaced by their alt text
+func (r *pdfRenderer) image(src string, alt string) {
+	file, ok := r.images[path.Base(src)]
+	if !ok {
+		return
+	}
+	data, kind := pdfImage(file)
+	if kind == "" {
+		if alt == "" {
+			alt = path.Base(src)
+		}
+		r.italic++
+		r.setFont()
+		r.text("[Image: " + alt + "]")
+		r.italic--
+		r.setFont()
+		return
+	}
+	r.block()
+	info := r.pdf.RegisterImageOptionsReader(file, fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(data))
+	if info == nil || r.pdf.Err() {
+		r.pdf.ClearError()
+		return
+	}
+
+	width := r.layout.Width - 2*r.layout.Margin - r.indent
+	height := r.layout.Height - 2*r.layout.Margin
+	w, h := info.Width(), info.Height()
+	if w > width {
+		w, h = width, h*width/w
+	}
+	if h > height {
+		w, h = w*height/h, height
+	}
+	x := r.layout.Margin + r.indent + (width-w)/2
+	r.pdf.ImageOptions(file, x, -1, w, h, true, fpdf.ImageOptions{ImageType: kind}, 0, "")
+	r.pdf.Ln(r.lineHeight() / 2)
+}
+
+// math places a formula rendered by SimplifyBook, its height and depth in
+// em come from the style of the img element. Inline formulas sit on the
+// baseline of the text, display formulas are centered on their own line
+func (r *pdfRenderer) math(src string, alt string, style string, display bool) {
+	file, ok := r.images[path.Base(src)]
+	m := mathStyleRe.FindStringSubmatch(style)
+	if !ok || m == nil {
+		r.text(alt)
+		return
+	}
+	data, kind := pdfImage(file)
+	if kind == "" {
+		r.text(alt)
+		return
+	}
+	info := r.pdf.RegisterImageOptionsReader(file, fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(data))
+	if info == nil || r.pdf.Err() {
+		r.pdf.ClearError()
+		r.text(alt)
+		return
+	}
+
+	// font sizes are in points, the page in millimetres
+	em := r.size * 25.4 / 72
+	height, _ := strconv.ParseFloat(m[1], 64)
+	depth, _ := strconv.ParseFloat(m[2], 64)
+	h, d := height*em, depth*em
+	w := h * info.Width() / info.Height()
+	width := r.layout.Width - 2*r.layout.Margin - r.indent
+	if w > width {
+		h, d, w = h*width/w, d*width/w, width
+	}
+
+	if display {
+		r.block()
+		x := r.layout.Margin + r.indent + (width-w)/2
+		r.pdf.ImageOptions(file, x, -1, w, h, true, fpdf.ImageOptions{ImageType: kind}, 0, "")
+		r.pdf.Ln(r.lineHeight() / 2)
+		return
+	}
+	if r.pdf.GetX()+w > r.layout.Width-r.layout.Margin {
+		r.pdf.Ln(r.lineHeight())
+	}
+	// fpdf centers text in the line, the baseline is 0.3 em below the middle
+	x, y := r.pdf.GetXY()
+	baseline := y + r.lineHeight()/2 + em*0.3
+	r.pdf.ImageOptions(file, x, baseline+d-h, w, h, false, fpdf.ImageOptions{ImageType: kind}, 0, "")
+	r.pdf.SetX(x + w)
+	r.pending = true
+}
+
+func (r *pdfRenderer) start(t xml.StartElement) {
+	name := strings.ToLower(t.Name.Local)
+	switch {
+	case name == "script" || name == "style" || name == "head":
+		r.skip++
+	case headingScale[name] > 0:
+		r.block()
+		r.pdf.Ln(r.lineHeight() / 2)
+		r.size = r.layout.FontSize * headingScale[name]
+		r.bold++
+		r.setFont()
+	case name == "pre":
+		r.block()
+		r.pre = &strings.Builder{}
+	case name == "br":
+		if r.pre != nil {
+			r.pre.WriteString("\n")
+			return
+		}
+		r.pdf.Ln(r.lineHeight())
+		r.pending = false
+	case name == "img":
+		var src, alt, class, style string
+		for _, attr := range t.Attr {
+			switch attr.Name.Local {
+			case "src":
+				src = attr.Value
+			case "alt":
+				alt = attr.Value
+			case "class":
+				class = attr.Value
+			case "style":
+				style = attr.Value
+			}
+		}
+		switch {
+		case src == "":
+		case strings.HasPrefix(class, "math"):
+			r.math(src, alt, style, strings.Contains(class, "display"))
+		default:
+			r.image(src, alt)
+		}
+	case name == "ul" || name == "ol":
+		r.block()
+		counter := -1
+		if name == "ol" {
+			counter = 0
+		}
+		r.lists = append(r.lists, counter)
+		r.setIndent(r.indent + r.size*0.5)
+	case name == "blockquote":
+		r.block()
+		r.setIndent(r.indent + r.size*0.5)
+	case name == "b" || name == "strong" || name == "th":
+		r.bold++
+		r.setFont()
+	case name == "i" || name == "em":
+		r.italic++
+		r.setFont()
+	case name == "code" || name == "kbd" || name == "samp" || name == "tt":
+		r.mono++
+		r.setFont()
+	}
+
+	switch {
+	case name == "li":
+		r.block()
+		bullet := "• "
+		if n := len(r.lists); n > 0 && r.lists[n-1] >= 0 {
+			r.lists[n-1]++
+			bullet = strconv.Itoa(r.lists[n-1]) + ". "
+		}
+		r.pdf.Write(r.lineHeight(), bullet)
+		r.pending = true
+	case name == "tr":
+		r.block()
+		r.cell = 0
+	case name == "td" || name == "th":
+		if r.cell > 0 {
+			r.pdf.Write(r.lineHeight(), " | ")
+		}
+		r.cell++
+	case blockElements[name]:
+		r.block()
+	}
+}
+
+func (r *pdfRenderer) end(t xml.EndElement) {
+	name := strings.ToLower(t.Name.Local)
+	switch {
+	case name == "script" || name == "style" || name == "head":
+		r.skip--
+	case headingScale[name] > 0:
+		r.block()
+		r.size = r.layout.FontSize
+		r.bold--
+		r.setFont()
+		r.pdf.Ln(r.lineHeight() / 2)
+	case name == "pre":
+		if r.pre != nil {
+			listing := r.pre.String()
+			r.pre = nil
+			r.code(listing)
+		}
+	case name == "ul" || name == "ol":
+		r.block()
+		if len(r.lists) > 0 {
+			r.lists = r.lists[:len(r.lists)-1]
+		}
+		r.setIndent(r.indent - r.size*0.5)
+	case name == "blockquote":
+		r.block()
+		r.setIndent(r.indent - r.size*0.5)
+	case name == "b" || name == "strong" || name == "th":
+		r.bold--
+		r.setFont()
+	case name == "i" || name == "em":
+		r.italic--
+		r.setFont()
+	case name == "code" || name == "kbd" || name == "samp" || name == "tt":
+		r.mono--
+		r.setFont()
+	case name == "p":
+		r.block()
+		r.pdf.Ln(r.lineHeight() / 2)
+	case blockElements[name]:
+		r.block()
+	}
+}
+
+func (r *pdfRenderer) section(body string) {
+	d := xml.NewDecoder(strings.NewReader(cleanXHTML(body)))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			r.start(t)
+		case xml.EndElement:
+			r.end(t)
+		case xml.CharData:
+			if r.skip == 0 {
+				r.text(string(t))
+			}
+		}
+	}
+	r.block()
+}
+
+func (r *pdfRenderer) cover(file string) {
+	data, kind := pdfImage(file)
+	if kind == "" {
+		return
+	}
+	info := r.pdf.RegisterImageOptionsReader(file, fpdf.ImageOptions{ImageType: kind}, bytes.NewReader(data))
+	if info == nil || r.pdf.Err() {
+		r.pdf.ClearError()
+		return
+	}
+	r.pdf.AddPage()
+	width := r.layout.Width - 2*r.layout.Margin
+	height := r.layout.Height - 2*r.layout.Margin
+	w, h := width, info.Height()*width/info.Width()
+	if h > height {
+		w, h = info.Width()*height/info.Height(), height
+	}
+	r.pdf.ImageOptions(file, (r.layout.Width-w)/2, (r.layout.Height-h)/2, w, h, false, fpdf.ImageOptions{ImageType: kind}, 0, "")
+}
+
+// WritePdf lays the book out as a paginated PDF with embedded fonts and
+// bookmarks for every chapter and section
+func WritePdf(book *Book, file string) error {
+	name := flagValue("page-size", "a4")
+	layout, ok := pageLayouts[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown page size %q, use a4, letter or 6in", name)
+	}
+	book = SimplifyBook(book, "PDF")
+
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "mm",
+		Size:    fpdf.SizeType{Wd: layout.Width, Ht: layout.Height},
+	})
+	pdf.SetTitle(book.Title, true)
+	pdf.SetAuthor(book.Author, true)
+	pdf.SetSubject(book.Description, true)
+	pdf.SetCreator("GoPacktpub-Downloader", true)
+	pdf.SetCreationDate(buildTime(book))
+	pdf.SetModificationDate(buildTime(book))
+	// fonts and images are kept in maps, sorted they come out in the same order
+	pdf.SetCatalogSort(deterministic())
+	// fpdf writes into the font data it is given, a copy keeps the next book
+	// of the run from embedding other bytes
+	for _, font := range []struct {
+		family, style string
+		ttf           []byte
+	}{
+		{"go", "", goregular.TTF},
+		{"go", "B", gobold.TTF},
+		{"go", "I", goitalic.TTF},
+		{"go", "BI", gobolditalic.TTF},
+		{"gomono", "", gomono.TTF},
+		{"gomono", "B", gomonobold.TTF},
+	} {
+		pdf.AddUTF8FontFromBytes(font.family, font.style, append([]byte(nil), font.ttf...))
+	}
+	pdf.SetMargins(layout.Margin, layout.Margin, layout.Margin)
+	pdf.SetAutoPageBreak(true, layout.Margin)
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-layout.Margin * 0.8)
+		pdf.SetFont("go", "", layout.FontSize*0.7)
+		pdf.CellFormat(0, layout.FontSize*0.3, strconv.Itoa(pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+
+	r := &pdfRenderer{pdf: pdf, layout: layout, size: layout.FontSize, images: map[string]string{}}
+	for _, image := range book.Assets {
+		r.images[image.Name] = image.Path
+	}
+	if book.Cover != "" {
+		r.cover(book.Cover)
+	}
+
+	for i, section := range book.Sections {
+		if section.Level == 0 || i == 0 {
+			pdf.AddPage()
+			r.pending = false
+		}
+		r.setFont()
+		pdf.Bookmark(section.Title, section.Level, -1)
+		r.section(section.Body)
+	}
+	if pdf.Err() {
+		return pdf.Error()
+	}
+	return pdf.OutputFileAndClose(file)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opds2Type       = "application/opds+json"
+	opdsAcquire     = "http://opds-spec.org/acquisition"
+	opdsImage       = "http://opds-spec.org/image"
+)
+
+// media types of the formats served, directories are not
+var formatMediaTypes = map[string]string{
+	"epub":  "application/epub+zip",
+	"kepub": "application/kepub+zip",
+	"azw3":  "application/vnd.amazon.ebook",
+	"mobi":  "application/x-mobipocket-ebook",
+	"pdf":   "application/pdf",
+	"txt":   "text/plain; charset=utf-8",
+	"html":  "text/html; charset=utf-8",
+}
+
+// facets books can be browsed by, the path segment and how to read them
+var facets = []struct {
+	Name   string
+	Title  string
+	Values func(b *shelfBook) []string
+}{
+	{"category", "By category", func(b *shelfBook) []string {
+		return nonEmpty(b.Summary.Meta.Category.CategoryName, b.Summary.Category)
+	}},
+	{"tool", "By tool", func(b *shelfBook) []string {
+		return nonEmpty(b.Summary.Meta.Tool.ToolName, b.Summary.Meta.Language.LanguageName)
+	}},
+	{"author", "By author", func(b *shelfBook) []string {
+		return b.Authors
+	}},
+}
+
+// shelfBook is a book of the library with all its formats
+type shelfBook struct {
+	ISBN    string
+	Title   string
+	Authors []string
+	Summary Summary
+	Updated time.Time
+	Files   []LibraryEntry
+}
+
+func nonEmpty(values ...string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// loadShelf reads the library, the catalog is opened for each request so
+// builds running at the same time can write to it
+func loadShelf() ([]*shelfBook, error) {
+	library, err := OpenLibrary()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := library.Entries("")
+	library.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	byISBN := map[string]*shelfBook{}
+	var books []*shelfBook
+	for _, entry := range entries {
+		if _, ok := formatMediaTypes[entry.Format]; !ok {
+			continue
+		}
+		if info, err := os.Stat(entry.Path); err != nil || info.IsDir() {
+			continue
+		}
+		book, ok := byISBN[entry.ISBN]
+		if !ok {
+			book = &shelfBook{ISBN: entry.ISBN}
+			byISBN[entry.ISBN] = book
+			books = append(books, book)
+		}
+		if entry.BuiltAt.After(book.Updated) {
+			book.Title, book.Authors, book.Summary, book.Updated = entry.Title, entry.Authors, entry.Summary, entry.BuiltAt
+		}
+		book.Files = append(book.Files, entry)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Updated.After(books[j].Updated) })
+	return books, nil
+}
+
+// matches tells if a book has the words of a search in its title, authors,
+// ISBN or subjects
+func (b *shelfBook) matches(query string) bool {
+	text := strings.ToLower(strings.Join(append(append([]string{b.Title, b.ISBN, b.Summary.OneLiner}, b.Authors...),
+		nonEmpty(b.Summary.Meta.Category.CategoryName, b.Summary.Meta.Tool.ToolName, b.Summary.Meta.Concepts.ConceptName)...), " "))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterShelf keeps the books of a search or facet value of the request
+func filterShelf(books []*shelfBook, r *http.Request) []*shelfBook {
+	query := r.URL.Query()
+	var out []*shelfBook
+	for _, book := range books {
+		if q := query.Get("q"); q != "" && !book.matches(q) {
+			continue
+		}
+		keep := true
+		for _, facet := range facets {
+			if want := query.Get(facet.Name); want != "" && !contains(facet.Values(book), want) {
+				keep = false
+			}
+		}
+		if keep {
+			out = append(out, book)
+		}
+	}
+	return out
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// facetValues counts the books of every value of a facet
+func facetValues(books []*shelfBook, name string) ([]string, map[string]int) {
+	counts := map[string]int{}
+	for _, facet := range facets {
+		if facet.Name != name {
+			continue
+		}
+		for _, book := range books {
+			for _, v := range facet.Values(book) {
+				counts[v]++
+			}
+		}
+	}
+	var values []string
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, counts
+}
+
+func fileHref(entry LibraryEntry) string {
+	return "/files/" + url.PathEscape(entry.ISBN) + "/" + url.PathEscape(entry.Format)
+}
+
+// OPDS 1.2
+
+type atomLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Count int    `xml:"thr:count,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []atomAuthor   `xml:"author"`
+	Identifier string         `xml:"dc:identifier,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Publisher  string         `xml:"dc:publisher,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    *atomContent   `xml:"content,omitempty"`
+	Links      []atomLink     `xml:"link"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	DC      string      `xml:"xmlns:dc,attr"`
+	OPDS    string      `xml:"xmlns:opds,attr"`
+	Thr     string      `xml:"xmlns:thr,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func newFeed(id string, title string, self string, kind string) *atomFeed {
+	return &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		DC:      "http://purl.org/dc/terms/",
+		OPDS:    "http://opds-spec.org/2010/catalog",
+		Thr:     "http://purl.org/syndication/thread/1.0",
+		ID:      "urn:packt:" + id,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigation},
+			{Rel: "search", Href: "/opds/search.xml", Type: "application/opensearchdescription+xml"},
+		},
+	}
+}
+
+func bookEntry(book *shelfBook) atomEntry {
+	entry := atomEntry{
+		Title:      book.Title,
+		ID:         "urn:isbn:" + book.ISBN,
+		Updated:    book.Updated.UTC().Format(time.RFC3339),
+		Identifier: "urn:isbn:" + book.ISBN,
+		Language:   "en",
+		Publisher:  book.Summary.Publisher,
+		Summary:    book.Summary.OneLiner,
+	}
+	if !book.Summary.PublicationDate.IsZero() {
+		entry.Issued = book.Summary.PublicationDate.Format("2006-01-02")
+	}
+	if book.Summary.About != "" {
+		entry.Content = &atomContent{Type: "html", Body: book.Summary.About}
+	}
+	for _, author := range book.Authors {
+		entry.Authors = append(entry.Authors, atomAuthor{Name: author})
+	}
+	for _, facet := range facets[:2] {
+		for _, v := range facet.Values(book) {
+			entry.Categories = append(entry.Categories, atomCategory{Term: v, Label: v})
+		}
+	}
+	if cover := book.Summary.CoverImage; cover != "" {
+		entry.Links = append(entry.Links,
+			atomLink{Rel: opdsImage, Href: cover, Type: "image/jpeg"},
+			atomLink{Rel: opdsImage + "/thumbnail", Href: cover, Type: "image/jpeg"})
+	}
+	for _, file := range book.Files {
+		entry.Links = append(entry.Links, atomLink{Rel: opdsAcquire, Href: fileHref(file), Type: formatMediaTypes[file.Format], Title: strings.ToUpper(file.Format)})
+	}
+	return entry
+}
+
+func writeFeed(w http.ResponseWriter, feed *atomFeed, kind string) {
+	w.Header().Set("Content-Type", kind+";charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		color.Red(err.Error())
+	}
+}
+
+func navigationEntry(id string, title string, href string, kind string, count int) atomEntry {
+	link := atomLink{Rel: "subsection", Href: href, Type: kind, Count: count}
+	return atomEntry{Title: title, ID: "urn:packt:" + id, Updated: time.Now().UTC().Format(time.RFC3339), Links: []atomLink{link}}
+}
+
+// OPDS 2.0
+
+type opds2Link struct {
+	Rel       string `json:"rel,omitempty"`
+	Href      string `json:"href"`
+	Type      string `json:"type,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Templated bool   `json:"templated,omitempty"`
+}
+
+type opds2Publication struct {
+	Metadata map[string]interface{} `json:"metadata"`
+	Links    []opds2Link            `json:"links"`
+	Images   []opds2Link            `json:"images,omitempty"`
+}
+
+type opds2Feed struct {
+	Metadata     map[string]interface{} `json:"metadata"`
+	Links        []opds2Link            `json:"links"`
+	Navigation   []opds2Link            `json:"navigation,omitempty"`
+	Facets       []opds2Group           `json:"facets,omitempty"`
+	Publications []opds2Publication     `json:"publications,omitempty"`
+}
+
+type opds2Group struct {
+	Metadata map[string]interface{} `json:"metadata"`
+	Links    []opds2Link            `json:"links"`
+}
+
+func publication(book *shelfBook) opds2Publication {
+	var authors []map[string]string
+	for _, author := range book.Authors {
+		authors = append(authors, map[string]string{"name": author})
+	}
+	metadata := map[string]interface{}{
+		"@type":      "http://schema.org/Book",
+		"title":      book.Title,
+		"identifier": "urn:isbn:" + book.ISBN,
+		"language":   "en",
+		"modified":   book.Updated.UTC().Format(time.RFC3339),
+	}
+	if len(authors) > 0 {
+		metadata["author"] = authors
+	}
+	if book.Summary.Publisher != "" {
+		metadata["publisher"] = book.Summary.Publisher
+	}
+	if !book.Summary.PublicationDate.IsZero() {
+		metadata["published"] = book.Summary.PublicationDate.Format("2006-01-02")
+	}
+	if book.Summary.About != "" {
+		metadata["description"] = book.Summary.About
+	}
+	if subjects := nonEmpty(append(facets[0].Values(book), facets[1].Values(book)...)...); len(subjects) > 0 {
+		metadata["subject"] = subjects
+	}
+	pub := opds2Publication{Metadata: metadata}
+	for _, file := range book.Files {
+		pub.Links = append(pub.Links, opds2Link{Rel: opdsAcquire, Href: fileHref(file), Type: formatMediaTypes[file.Format], Title: strings.ToUpper(file.Format)})
+	}
+	if cover := book.Summary.CoverImage; cover != "" {
+		pub.Images = []opds2Link{{Href: cover, Type: "image/jpeg"}}
+	}
+	return pub
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", opds2Type)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		color.Red(err.Error())
+	}
+}
+
+// opdsHandler serves the library as OPDS 1.2 under /opds and OPDS 2.0
+// under /opds2, with the book files under /files
+func opdsHandler(title string) http.Handler {
+	mux := http.NewServeMux()
+	shelf := func(w http.ResponseWriter) ([]*shelfBook, bool) {
+		books, err := loadShelf()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return nil, false
+		}
+		return books, true
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, "/opds", http.StatusFound)
+	})
+
+	mux.HandleFunc("/opds", func(w http.ResponseWriter, r *http.Request) {
+		books, ok := shelf(w)
+		if !ok {
+			return
+		}
+		feed := newFeed("root", title, "/opds", opdsNavigation)
+		feed.Entries = append(feed.Entries, navigationEntry("all", "All books", "/opds/books", opdsAcquisition, len(books)))
+		for _, facet := range facets {
+			values, _ := facetValues(books, facet.Name)
+			feed.Entries = append(feed.Entries, navigationEntry(facet.Name, facet.Title, "/opds/"+facet.Name, opdsNavigation, len(values)))
+		}
+		writeFeed(w, feed, opdsNavigation)
+	})
+
+	mux.HandleFunc("/opds/books", func(w http.ResponseWriter, r *http.Request) {
+		books, ok := shelf(w)
+		if !ok {
+			return
+		}
+		heading := "All books"
+		if q := r.URL.Query().Get("q"); q != "" {
+			heading = "Search: " + q
+		}
+		for _, facet := range facets {
+			if v := r.URL.Query().Get(facet.Name); v != "" {
+				heading = v
+			}
+		}
+		feed := newFeed("books:"+r.URL.RawQuery, heading, r.URL.RequestURI(), opdsAcquisition)
+		for _, book := range filterShelf(books, r) {
+			feed.Entries = append(feed.Entries, bookEntry(book))
+		}
+		writeFeed(w, feed, opdsAcquisition)
+	})
+
+	for _, facet := range facets {
+		facet := facet
+		mux.HandleFunc("/opds/"+facet.Name, func(w http.ResponseWriter, r *http.Request) {
+			books, ok := shelf(w)
+			if !ok {
+				return
+			}
+			feed := newFeed(facet.Name, facet.Title, "/opds/"+facet.Name, opdsNavigation)
+			values, counts := facetValues(books, facet.Name)
+			for _, v := range values {
+				href := "/opds/books?" + url.Values{facet.Name: {v}}.Encode()
+				feed.Entries = append(feed.Entries, navigationEntry(facet.Name+":"+v, v, href, opdsAcquisition, counts[v]))
+			}
+			writeFeed(w, feed, opdsNavigation)
+		})
+	}
+
+	mux.HandleFunc("/opds/search.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+  <ShortName>%s</ShortName>
+  <Description>Search the books of %s</Description>
+  <Url type="%s" template="/opds/books?q={searchTerms}"/>
+</OpenSearchDescription>
+`, xhtmlEscaper.Replace(title), xhtmlEscaper.Replace(title), opdsAcquisition)
+	})
+
+	mux.HandleFunc("/opds2", func(w http.ResponseWriter, r *http.Request) {
+		books, ok := shelf(w)
+		if !ok {
+			return
+		}
+		feed := opds2Feed{
+			Metadata: map[string]interface{}{"title": title},
+			Links: []opds2Link{
+				{Rel: "self", Href: "/opds2", Type: opds2Type},
+				{Rel: "search", Href: "/opds2/publications{?query}", Type: opds2Type, Templated: true},
+			},
+			Navigation: []opds2Link{{Href: "/opds2/publications", Title: "All books", Type: opds2Type}},
+		}
+		for _, facet := range facets {
+			values, _ := facetValues(books, facet.Name)
+			group := opds2Group{Metadata: map[string]interface{}{"title": facet.Title}}
+			for _, v := range values {
+				group.Links = append(group.Links, opds2Link{Href: "/opds2/publications?" + url.Values{facet.Name: {v}}.Encode(), Title: v, Type: opds2Type})
+			}
+			feed.Facets = append(feed.Facets, group)
+		}
+		writeJSON(w, feed)
+	})
+
+	mux.HandleFunc("/opds2/publications", func(w http.ResponseWriter, r *http.Request) {
+		books, ok := shelf(w)
+		if !ok {
+			return
+		}
+		// OPDS 2.0 templates name the search "query"
+		if q := r.URL.Query().Get("query"); q != "" {
+			values := r.URL.Query()
+			values.Set("q", q)
+			r.URL.RawQuery = values.Encode()
+		}
+		feed := opds2Feed{
+			Metadata: map[string]interface{}{"title": title},
+			Links:    []opds2Link{{Rel: "self", Href: r.URL.RequestURI(), Type: opds2Type}, {Rel: "start", Href: "/opds2", Type: opds2Type}},
+		}
+		filtered := filterShelf(books, r)
+		feed.Metadata["numberOfItems"] = len(filtered)
+		feed.Publications = []opds2Publication{}
+		for _, book := range filtered {
+			feed.Publications = append(feed.Publications, publication(book))
+		}
+		writeJSON(w, feed)
+	})
+
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		books, ok := shelf(w)
+		if !ok {
+			return
+		}
+		for _, book := range books {
+			if book.ISBN != parts[0] {
+				continue
+			}
+			for _, file := range book.Files {
+				if file.Format == parts[1] {
+					w.Header().Set("Content-Type", formatMediaTypes[file.Format])
+					w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(filepath.Base(file.Path), `"`, "", -1)+`"`)
+					http.ServeFile(w, r, file.Path)
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+// Serve runs the OPDS catalog until the process is stopped
+func Serve() error {
+	addr := flagValue("listen", ":8080")
+	title := flagValue("title", "Packt library")
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           opdsHandler(title),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Println("OPDS catalog on http://" + strings.Replace(addr, "0.0.0.0", "localhost", 1) + "/opds (OPDS 2.0: /opds2)")
+	return server.ListenAndServe()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFilterShelf(t *testing.T) {
+	goBook := &shelfBook{ISBN: "9781800207974", Title: "Mastering Go", Authors: []string{"Mihalis Tsoukalos"}}
+	goBook.Summary.Category = "Programming"
+	goBook.Summary.Meta.Tool.ToolName = "Go"
+
+	k8sBook := &shelfBook{ISBN: "9781838827076", Title: "The Kubernetes Workshop", Authors: []string{"Zachary Arnold", "Sahil Dua"}}
+	k8sBook.Summary.Meta.Category.CategoryName = "Cloud & Networking"
+	k8sBook.Summary.Meta.Tool.ToolName = "Kubernetes"
+	k8sBook.Summary.Meta.Language.LanguageName = "Go"
+
+	books := []*shelfBook{goBook, k8sBook}
+	tests := []struct {
+		query string
+		want  []*shelfBook
+	}{
+		{"", books},
+		{"q=go", []*shelfBook{goBook}},
+		{"q=MASTERING+tsoukalos", []*shelfBook{goBook}},
+		{"q=9781838827076", []*shelfBook{k8sBook}},
+		{"q=kubernetes+go", nil},
+		{"tool=Go", books},
+		{"tool=Kubernetes", []*shelfBook{k8sBook}},
+		{"category=Cloud+%26+Networking", []*shelfBook{k8sBook}},
+		{"author=Sahil+Dua", []*shelfBook{k8sBook}},
+		{"tool=Go&author=Mihalis+Tsoukalos", []*shelfBook{goBook}},
+		{"tool=go", nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/opds/search?"+tt.query, nil)
+		if got := filterShelf(books, r); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filterShelf(%q) = %d books, want %d", tt.query, len(got), len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// svgScale is how many pixels an SVG unit becomes, twice the CSS pixel
+	// keeps diagrams sharp on e-readers
+	svgScale = 2
+	// svgMaxWidth limits the size of wide diagrams
+	svgMaxWidth = 1600
+)
+
+var (
+	transformRe = regexp.MustCompile(`(\w+)\s*\(([^)]*)\)`)
+	numberSepRe = regexp.MustCompile(`[\s,]+`)
+)
+
+// RenderSVG draws an SVG image as PNG on white. Shapes are drawn by oksvg,
+// text, which oksvg skips, is drawn on top with the Go fonts
+func RenderSVG(data []byte) ([]byte, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, errors.New("svg has no size")
+	}
+	scale := math.Min(svgScale, svgMaxWidth/icon.ViewBox.W)
+	w, h := int(math.Ceil(icon.ViewBox.W*scale)), int(math.Ceil(icon.ViewBox.H*scale))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	icon.Draw(rasterx.NewDasher(w, h, rasterx.NewScannerGV(w, h, img, img.Bounds())), 1)
+	if err := drawSVGText(img, data, icon.Transform); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// svgNumbers reads a list of numbers like the arguments of a transform
+func svgNumbers(s string) []float64 {
+	var numbers []float64
+	for _, field := range numberSepRe.Split(strings.TrimSpace(s), -1) {
+		if f, err := strconv.ParseFloat(field, 64); err == nil {
+			numbers = append(numbers, f)
+		}
+	}
+	return numbers
+}
+
+// svgTransform applies a transform attribute to the matrix m
+func svgTransform(m rasterx.Matrix2D, s string) rasterx.Matrix2D {
+	for _, t := range transformRe.FindAllStringSubmatch(s, -1) {
+		v := svgNumbers(t[2])
+		n := len(v)
+		v = append(v, 0, 0, 0, 0, 0, 0)
+		switch t[1] {
+		case "translate":
+			m = m.Translate(v[0], v[1])
+		case "scale":
+			if n == 1 {
+				v[1] = v[0]
+			}
+			m = m.Scale(v[0], v[1])
+		case "rotate":
+			m = m.Translate(v[1], v[2]).Rotate(v[0]*math.Pi/180).Translate(-v[1], -v[2])
+		case "skewX":
+			m = m.SkewX(v[0] * math.Pi / 180)
+		case "skewY":
+			m = m.SkewY(v[0] * math.Pi / 180)
+		case "matrix":
+			m = m.Mult(rasterx.Matrix2D{A: v[0], B: v[1], C: v[2], D: v[3], E: v[4], F: v[5]})
+		}
+	}
+	return m
+}
+
+// svgLength reads a coordinate or font size, em is relative to size
+func svgLength(s string, size float64) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if fields := numberSepRe.Split(s, 2); len(fields) > 1 {
+		s = fields[0]
+	}
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(s, "em"):
+		s, unit = strings.TrimSuffix(s, "em"), size
+	case strings.HasSuffix(s, "pt"):
+		s, unit = strings.TrimSuffix(s, "pt"), 4.0/3
+	case strings.HasSuffix(s, "px"):
+		s = strings.TrimSuffix(s, "px")
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f * unit, true
+}
+
+// svgTextStyle is the inherited state of the text drawing pass
+type svgTextStyle struct {
+	m      rasterx.Matrix2D
+	fill   color.Color
+	size   float64
+	anchor string
+	font   string
+	hidden bool
+	text   bool
+}
+
+// apply reads the presentation attributes and the style attribute of an
+// element, the style attribute wins
+func (s *svgTextStyle) apply(attrs []xml.Attr) {
+	props := map[string]string{}
+	style := ""
+	for _, attr := range attrs {
+		if attr.Name.Local == "style" {
+			style = attr.Value
+			continue
+		}
+		props[attr.Name.Local] = attr.Value
+	}
+	for _, decl := range strings.Split(style, ";") {
+		if i := strings.Index(decl, ":"); i > 0 {
+			props[strings.TrimSpace(decl[:i])] = strings.TrimSpace(decl[i+1:])
+		}
+	}
+	if v, ok := props["transform"]; ok {
+		s.m = svgTransform(s.m, v)
+	}
+	if v, ok := props["fill"]; ok {
+		switch v {
+		case "none":
+			s.fill = nil
+		case "currentColor":
+			s.fill = color.Black
+		default:
+			if c, err := oksvg.ParseSVGColor(v); err == nil && c != nil {
+				s.fill = c
+			}
+		}
+	}
+	if v, ok := props["font-size"]; ok {
+		if size, ok := svgLength(v, s.size); ok {
+			s.size = size
+		}
+	}
+	if v, ok := props["text-anchor"]; ok {
+		s.anchor = v
+	}
+	if v := props["font-family"]; strings.Contains(strings.ToLower(v), "mono") || strings.Contains(strings.ToLower(v), "courier") {
+		s.font = "mono"
+	}
+	if v := props["font-weight"]; v == "bold" || v == "bolder" || v == "600" || v == "700" || v == "800" || v == "900" {
+		s.font = "bold"
+	}
+	if props["display"] == "none" || props["visibility"] == "hidden" {
+		s.hidden = true
+	}
+}
+
+// svgHidden are elements whose content is never drawn in place
+var svgHidden = map[string]bool{
+	"defs": true, "title": true, "desc": true, "metadata": true, "clipPath": true, "symbol": true,
+	"marker": true, "pattern": true, "mask": true, "style": true, "script": true,
+}
+
+// drawSVGText draws the text and tspan elements of an SVG, base maps SVG
+// units to pixels. Text keeps its position, size and color but is not rotated
+func drawSVGText(dst *image.RGBA, data []byte, base rasterx.Matrix2D) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	t := newTypesetter()
+	stack := []svgTextStyle{{m: base, fill: color.Black, size: 16, anchor: "start", font: "regular"}}
+	var x, y float64
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		top := stack[len(stack)-1]
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			style := top
+			style.apply(tok.Attr)
+			name := tok.Name.Local
+			if svgHidden[name] {
+				style.hidden = true
+			}
+			if name == "text" || name == "tspan" {
+				style.text = true
+				for _, attr := range tok.Attr {
+					v, ok := svgLength(attr.Value, style.size)
+					if !ok {
+						continue
+					}
+					switch attr.Name.Local {
+					case "x":
+						x = v
+					case "y":
+						y = v
+					case "dx":
+						x += v
+					case "dy":
+						y += v
+					}
+				}
+			}
+			stack = append(stack, style)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			s := strings.Join(strings.Fields(string(tok)), " ")
+			if !top.text || top.hidden || s == "" {
+				continue
+			}
+			scale := math.Sqrt(math.Abs(top.m.A*top.m.D - top.m.B*top.m.C))
+			if scale*top.size <= 0 {
+				continue
+			}
+			face := t.face(top.font, top.size*scale)
+			width := fromFixed(font.MeasureString(face, s))
+			px, py := top.m.Transform(x, y)
+			switch top.anchor {
+			case "middle":
+				px -= width / 2
+			case "end":
+				px -= width
+			}
+			if top.fill != nil {
+				dr := font.Drawer{Dst: dst, Src: image.NewUniform(top.fill), Face: face, Dot: fixed.Point26_6{X: toFixed(px), Y: toFixed(py)}}
+				dr.DrawString(s)
+			}
+			x += width / scale
+		}
+	}
+}
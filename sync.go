@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+var (
+	ordinalRe      = regexp.MustCompile(`^(\d+)(st|nd|rd|th)?$`)
+	editionTitleRe = regexp.MustCompile(`(?i)[\s,:–-]*\b\w+\s+edition\b`)
+)
+
+var ordinals = map[string]int{
+	"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5,
+	"sixth": 6, "seventh": 7, "eighth": 8, "ninth": 9, "tenth": 10,
+}
+
+// fingerprint identifies the content of a section as it was downloaded
+func fingerprint(page string) string {
+	sum := sha256.Sum256([]byte(page))
+	return hex.EncodeToString(sum[:])
+}
+
+// SectionKey names a section by the ids of its chapter and section, the
+// indexes are the ones WalkToc passes
+func (toc TOC) SectionKey(part string, chapter int, section int) string {
+	for _, p := range toc.Parts() {
+		if p.Name == part && chapter < len(p.Chapters) && section < len(p.Chapters[chapter].Sections) {
+			return p.Chapters[chapter].ID + "/" + p.Chapters[chapter].Sections[section].ID
+		}
+	}
+	return fmt.Sprintf("%s/%d/%d", part, chapter, section)
+}
+
+// sectionTitles maps the key of every section to a readable title
+func (toc TOC) sectionTitles() map[string]string {
+	titles := map[string]string{}
+	for _, part := range toc.Parts() {
+		for _, chapter := range part.Chapters {
+			for _, section := range chapter.Sections {
+				title := chapter.Title
+				if section.Title != "" && section.Title != chapter.Title {
+					title += " / " + section.Title
+				}
+				titles[chapter.ID+"/"+section.ID] = title
+			}
+		}
+	}
+	return titles
+}
+
+// diffToc lists the chapters and sections added to or removed from a book
+func diffToc(old TOC, current TOC) []string {
+	var changes []string
+	oldChapters := map[string]bool{}
+	for _, part := range old.Parts() {
+		for _, chapter := range part.Chapters {
+			oldChapters[chapter.ID] = true
+		}
+	}
+	for _, part := range current.Parts() {
+		for _, chapter := range part.Chapters {
+			if !oldChapters[chapter.ID] {
+				changes = append(changes, "new chapter: "+chapter.Title)
+			}
+		}
+	}
+
+	oldTitles, titles := old.sectionTitles(), current.sectionTitles()
+	var added, removed []string
+	for key, title := range titles {
+		chapter := strings.SplitN(key, "/", 2)[0]
+		if _, ok := oldTitles[key]; !ok && oldChapters[chapter] {
+			added = append(added, "new section: "+title)
+		}
+	}
+	for key, title := range oldTitles {
+		if _, ok := titles[key]; !ok {
+			removed = append(removed, "removed section: "+title)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return append(append(changes, added...), removed...)
+}
+
+// summaryChanges lists what changed in the description of a book
+func summaryChanges(old Summary, current Summary) []string {
+	var changes []string
+	if !old.PublicationDate.Equal(current.PublicationDate) {
+		changes = append(changes, "publication date "+old.PublicationDate.Format("2006-01-02")+" -> "+current.PublicationDate.Format("2006-01-02"))
+	}
+	if old.Pages != current.Pages {
+		changes = append(changes, fmt.Sprintf("pages %d -> %d", old.Pages, current.Pages))
+	}
+	if old.Length != current.Length {
+		changes = append(changes, "length "+old.Length+" -> "+current.Length)
+	}
+	if old.EarlyAccess != current.EarlyAccess || old.Releasing != current.Releasing {
+		changes = append(changes, "early access finished")
+		if current.EarlyAccess || current.Releasing {
+			changes[len(changes)-1] = "early access started"
+		}
+	}
+	return changes
+}
+
+// changedSections downloads every section and lists the ones whose content
+// differs from the fingerprints of the last build
+func changedSections(token string, isbn string, toc TOC, fingerprints map[string]string) ([]string, error) {
+	titles := toc.sectionTitles()
+	var changes []string
+	err := WalkToc(token, isbn, toc, func(part string, chapter int, section int, title string, page string) {
+		key := toc.SectionKey(part, chapter, section)
+		if old, ok := fingerprints[key]; ok && old != fingerprint(page) {
+			changes = append(changes, "changed section: "+titles[key])
+		}
+	})
+	return changes, err
+}
+
+// editionNumber reads "Second Edition" or "2nd Edition" in a title, a title
+// without one is the first edition
+func editionNumber(title string) int {
+	edition := strings.ToLower(bookEdition(title))
+	if n, ok := ordinals[edition]; ok {
+		return n
+	}
+	if m := ordinalRe.FindStringSubmatch(edition); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 1
+}
+
+// newEditions searches for later editions of a title
+func newEditions(isbn string, title string) ([]string, error) {
+	base := strings.TrimSpace(editionTitleRe.ReplaceAllString(title, ""))
+	edition := editionNumber(title)
+	result, err := Search(base)
+	if err != nil || len(result.Results) == 0 {
+		return nil, err
+	}
+	var editions []string
+	for _, hit := range result.Results[0].Hits {
+		if hit.PrintIsbn13 == isbn || hit.PrintIsbn13 == "" {
+			continue
+		}
+		if !strings.EqualFold(strings.TrimSpace(editionTitleRe.ReplaceAllString(hit.Title, "")), base) {
+			continue
+		}
+		if editionNumber(hit.Title) > edition {
+			editions = append(editions, "new edition: "+hit.PrintIsbn13+" - "+hit.PublishedYear+" - "+hit.Title+", download it with get "+hit.PrintIsbn13)
+		}
+	}
+	return editions, nil
+}
+
+// SyncLibrary checks the books of the library against Packt and rebuilds
+// the ones that changed. Sections are compared one by one, which downloads
+// them all, --quick only compares the metadata and the table of contents of
+// books that are not in early access
+func SyncLibrary(token string, args []string) error {
+	library, err := OpenLibrary()
+	if err != nil {
+		return err
+	}
+	entries, err := library.Entries("")
+	library.Close()
+	if err != nil {
+		return err
+	}
+
+	byISBN := map[string][]LibraryEntry{}
+	var isbns []string
+	for _, entry := range entries {
+		if len(args) > 0 && entry.ISBN != args[0] {
+			continue
+		}
+		if _, ok := byISBN[entry.ISBN]; !ok {
+			isbns = append(isbns, entry.ISBN)
+		}
+		byISBN[entry.ISBN] = append(byISBN[entry.ISBN], entry)
+	}
+	if len(isbns) == 0 {
+		if len(args) > 0 {
+			return fmt.Errorf("%s is not in the library", args[0])
+		}
+		return errors.New("the library is empty")
+	}
+	sort.Strings(isbns)
+
+	// sections compared are not downloaded again for the rebuild, the
+	// workspace and this cache are removed when the run ends
+	sectionCache = filepath.Join(workDir, "sections")
+	rebuilt, failed := 0, 0
+	for _, isbn := range isbns {
+		built, err := syncBook(token, isbn, byISBN[isbn])
+		if err != nil {
+			color.Red("  " + err.Error())
+			failed++
+			continue
+		}
+		if built {
+			rebuilt++
+		}
+	}
+	fmt.Printf("%d books checked, %d rebuilt\n", len(isbns), rebuilt)
+	if failed > 0 {
+		return fmt.Errorf("%d books could not be checked or rebuilt", failed)
+	}
+	return nil
+}
+
+// syncBook checks one book against Packt and rebuilds its formats when it
+// changed, it tells if the book was rebuilt
+func syncBook(token string, isbn string, builds []LibraryEntry) (bool, error) {
+	// the latest build is the reference
+	last := builds[0]
+	for _, entry := range builds {
+		if entry.BuiltAt.After(last.BuiltAt) {
+			last = entry
+		}
+	}
+	color.Blue(isbn + " - " + last.Title)
+
+	summary, err := GetSummary(isbn)
+	if err != nil {
+		return false, err
+	}
+	changes := summaryChanges(last.Summary, summary)
+	toc, err := GetToc(isbn)
+	if err != nil {
+		return false, err
+	}
+	if len(last.Fingerprints) == 0 {
+		changes = append(changes, "no fingerprints recorded by the last build")
+	} else {
+		changes = append(changes, diffToc(last.Toc, toc)...)
+		if !flagSet("quick") || summary.EarlyAccess || summary.Releasing {
+			sections, err := changedSections(token, isbn, toc, last.Fingerprints)
+			if err != nil {
+				return false, err
+			}
+			changes = append(changes, sections...)
+		}
+	}
+	editions, err := newEditions(isbn, summary.Title)
+	if err != nil {
+		color.Yellow("  editions not searched: " + err.Error())
+	}
+	for _, edition := range editions {
+		fmt.Println("  " + edition)
+	}
+	if len(changes) == 0 {
+		fmt.Println("  up to date")
+		return false, nil
+	}
+	for _, change := range changes {
+		fmt.Println("  " + change)
+	}
+	if flagSet("dry-run") {
+		return false, nil
+	}
+
+	book, err := FetchMetadata(isbn)
+	if err != nil {
+		return false, err
+	}
+	var formats []string
+	paths := map[string]string{}
+	for _, entry := range builds {
+		if _, ok := writers[entry.Format]; ok {
+			formats = append(formats, entry.Format)
+			paths[entry.Format] = entry.Path
+		}
+	}
+	outputs, err := BuildBook(token, book, formats, paths)
+	for _, output := range outputs {
+		fmt.Println("  Output : " + output)
+	}
+	return err == nil, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditionNumber(t *testing.T) {
+	tests := []struct {
+		title string
+		want  int
+	}{
+		{"Mastering Go", 1},
+		{"Mastering Go - Third Edition", 3},
+		{"Mastering Go, second edition", 2},
+		{"Kubernetes Patterns 2nd Edition", 2},
+		{"Learn Rust: 10th Edition", 10},
+		{"Python Cookbook - Special Edition", 1},
+	}
+	for _, tt := range tests {
+		if got := editionNumber(tt.title); got != tt.want {
+			t.Errorf("editionNumber(%q) = %d, want %d", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestDiffToc(t *testing.T) {
+	chapter := func(id string, title string, sections ...TocSection) TocChapter {
+		return TocChapter{ID: id, Title: title, Sections: sections}
+	}
+	section := func(id string, title string) TocSection {
+		return TocSection{ID: id, Title: title}
+	}
+	old := TOC{
+		Prefaces: []TocChapter{chapter("p1", "Preface", section("s1", "Preface"))},
+		Chapters: []TocChapter{
+			chapter("c1", "One", section("s1", "One"), section("s2", "Two")),
+			chapter("c2", "Two", section("s1", "Two")),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		current TOC
+		want    []string
+	}{
+		{"unchanged", old, nil},
+		{"new chapter", TOC{
+			Prefaces: old.Prefaces,
+			Chapters: append(append([]TocChapter{}, old.Chapters...), chapter("c3", "Three", section("s1", "Three"), section("s2", "More"))),
+		}, []string{"new chapter: Three"}},
+		{"sections added and removed", TOC{
+			Prefaces: old.Prefaces,
+			Chapters: []TocChapter{
+				chapter("c1", "One", section("s1", "One"), section("s3", "Three")),
+				chapter("c2", "Two", section("s1", "Two")),
+			},
+		}, []string{"new section: One / Three", "removed section: One / Two"}},
+		{"chapter removed", TOC{
+			Chapters: old.Chapters[:1],
+		}, []string{"removed section: Preface", "removed section: Two"}},
+	}
+	for _, tt := range tests {
+		if got := diffToc(old, tt.current); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffToc = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
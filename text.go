@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const textWidth = 72
+
+var headingUnderline = map[int]string{1: "=", 2: "-"}
+
+func init() {
+	RegisterWriter("txt", writerFunc{".txt", WriteText})
+}
+
+// txtRenderer turns the xhtml of a section into reflowed plain text
+type txtRenderer struct {
+	out     strings.Builder
+	text    strings.Builder
+	indent  int
+	lists   []int
+	item    string
+	heading int
+	pre     *strings.Builder
+	row     []string
+	cell    *strings.Builder
+	skip    int
+}
+
+// wrap reflows text to textWidth columns, the first line starts with first
+// and the others with rest
+func wrap(text string, first string, rest string) string {
+	var b strings.Builder
+	line := first
+	empty := true
+	for _, word := range strings.Fields(text) {
+		if !empty && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > textWidth {
+			b.WriteString(line + "\n")
+			line = rest
+			empty = true
+		}
+		if !empty {
+			line += " "
+		}
+		line += word
+		empty = false
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+func (r *txtRenderer) inline(s string) {
+	if r.cell != nil {
+		r.cell.WriteString(s)
+		return
+	}
+	r.text.WriteString(s)
+}
+
+func (r *txtRenderer) flush() {
+	text := strings.TrimSpace(r.text.String())
+	r.text.Reset()
+	if text == "" {
+		return
+	}
+	if r.heading > 0 {
+		text = strings.Join(strings.Fields(text), " ")
+		r.out.WriteString(text + "\n")
+		if underline, ok := headingUnderline[r.heading]; ok {
+			r.out.WriteString(strings.Repeat(underline, utf8.RuneCountInString(text)) + "\n")
+		}
+		r.out.WriteString("\n")
+		return
+	}
+	margin := strings.Repeat(" ", r.indent)
+	first := margin
+	if r.item != "" {
+		first = r.item
+		if len(margin) > len(r.item) {
+			first = margin[:len(margin)-len(r.item)] + r.item
+		}
+		r.item = ""
+	}
+	r.out.WriteString(wrap(text, first, margin) + "\n\n")
+}
+
+func (r *txtRenderer) start(t xml.StartElement) {
+	name := strings.ToLower(t.Name.Local)
+	if r.pre != nil {
+		if name == "br" {
+			r.pre.WriteString("\n")
+		}
+		if class := attrValue(t, "class"); class == "ln" || class == "lnt" {
+			r.skip++
+		}
+		return
+	}
+	switch {
+	case name == "script" || name == "style":
+		r.skip++
+	case headingLevel[name] > 0:
+		r.flush()
+		r.heading = headingLevel[name]
+	case mdBlocks[name]:
+		r.flush()
+	case name == "pre":
+		r.flush()
+		r.pre = &strings.Builder{}
+	case name == "ul" || name == "ol":
+		r.flush()
+		counter := -1
+		if name == "ol" {
+			counter = 0
+		}
+		r.lists = append(r.lists, counter)
+		r.indent += 4
+	case name == "li":
+		r.flush()
+		r.item = "  * "
+		if n := len(r.lists); n > 0 && r.lists[n-1] >= 0 {
+			r.lists[n-1]++
+			r.item = strconv.Itoa(r.lists[n-1]) + ". "
+			for len(r.item) < 4 {
+				r.item = " " + r.item
+			}
+		}
+	case name == "blockquote":
+		r.flush()
+		r.indent += 4
+	case name == "hr":
+		r.flush()
+		r.out.WriteString(strings.Repeat(" ", r.indent) + strings.Repeat("-", 20) + "\n\n")
+	case name == "tr":
+		r.flush()
+		r.row = nil
+	case name == "td" || name == "th":
+		r.cell = &strings.Builder{}
+	case name == "br":
+		r.flush()
+	case name == "img":
+		if alt := attrValue(t, "alt"); alt != "" {
+			r.inline(" [Image: " + alt + "] ")
+		} else {
+			r.inline(" [Image] ")
+		}
+	}
+}
+
+func (r *txtRenderer) end(t xml.EndElement) {
+	name := strings.ToLower(t.Name.Local)
+	if r.pre != nil && name != "pre" {
+		if r.skip > 0 && name == "span" {
+			r.skip--
+		}
+		return
+	}
+	switch {
+	case name == "script" || name == "style":
+		r.skip--
+	case name == "pre":
+		listing := strings.Trim(r.pre.String(), "\r\n")
+		r.pre = nil
+		margin := strings.Repeat(" ", r.indent+4)
+		for _, line := range strings.Split(listing, "\n") {
+			r.out.WriteString(strings.TrimRight(margin+strings.Replace(line, "\t", "    ", -1), " ") + "\n")
+		}
+		r.out.WriteString("\n")
+	case headingLevel[name] > 0:
+		r.flush()
+		r.heading = 0
+	case mdBlocks[name] || name == "li":
+		r.flush()
+	case name == "ul" || name == "ol":
+		r.flush()
+		if len(r.lists) > 0 {
+			r.lists = r.lists[:len(r.lists)-1]
+		}
+		r.indent -= 4
+	case name == "blockquote":
+		r.flush()
+		r.indent -= 4
+	case name == "td" || name == "th":
+		if r.cell != nil {
+			r.row = append(r.row, strings.Join(strings.Fields(r.cell.String()), " "))
+		}
+		r.cell = nil
+	case name == "tr":
+		r.out.WriteString(strings.Repeat(" ", r.indent) + strings.Join(r.row, " | ") + "\n")
+		r.row = nil
+	case name == "table":
+		r.out.WriteString("\n")
+	}
+}
+
+// HtmlToText converts a section body to plain text, headings are underlined,
+// code keeps its indentation and paragraphs are reflowed
+func HtmlToText(body string) string {
+	r := &txtRenderer{}
+	d := xml.NewDecoder(strings.NewReader(cleanXHTML(body)))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			r.start(t)
+		case xml.EndElement:
+			r.end(t)
+		case xml.CharData:
+			if r.skip > 0 {
+				continue
+			}
+			if r.pre != nil {
+				r.pre.WriteString(string(t))
+			} else {
+				r.inline(string(t))
+			}
+		}
+	}
+	r.flush()
+	return strings.TrimRight(r.out.String(), "\n") + "\n"
+}
+
+// WriteText writes the book as a single plain text file
+func WriteText(book *Book, path string) error {
+	var b strings.Builder
+	title := strings.ToUpper(book.Title)
+	b.WriteString(title + "\n" + strings.Repeat("=", utf8.RuneCountInString(title)) + "\n\n")
+	b.WriteString(book.Author + "\n\n")
+	if book.Description != "" {
+		b.WriteString(HtmlToText(book.Description) + "\n")
+	}
+	for _, section := range book.Sections {
+		if section.Level == 0 {
+			b.WriteString("\n" + strings.Repeat("*", textWidth) + "\n\n")
+		}
+		b.WriteString(HtmlToText(section.Body) + "\n")
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Problem is something wrong in an EPUB file, errors make readers reject the
+// book, warnings are likely to render badly
+type Problem struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ValidationReport is the result of ValidateEpub
+type ValidationReport struct {
+	Path     string    `json:"path"`
+	Valid    bool      `json:"valid"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+	Problems []Problem `json:"problems"`
+}
+
+func (r *ValidationReport) add(severity string, file string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Severity: severity, File: file, Message: fmt.Sprintf(format, args...)})
+	if severity == "error" {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+func (r *ValidationReport) String() string {
+	var b strings.Builder
+	for _, p := range r.Problems {
+		file := ""
+		if p.File != "" {
+			file = p.File + ": "
+		}
+		fmt.Fprintf(&b, "%-7s %s%s\n", p.Severity, file, p.Message)
+	}
+	fmt.Fprintf(&b, "%s: %d errors, %d warnings\n", r.Path, r.Errors, r.Warnings)
+	return b.String()
+}
+
+type opfPackage struct {
+	Version  string `xml:"version,attr"`
+	Metadata struct {
+		Identifiers []string `xml:"identifier"`
+		Titles      []string `xml:"title"`
+		Languages   []string `xml:"language"`
+	} `xml:"metadata"`
+	Items []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		Toc      string `xml:"toc,attr"`
+		ItemRefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// media types readers expect for the usual file extensions
+var epubMediaTypes = map[string]string{
+	".xhtml": "application/xhtml+xml",
+	".html":  "application/xhtml+xml",
+	".css":   "text/css",
+	".ncx":   "application/x-dtbncx+xml",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".svg":   "image/svg+xml",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".js":    "application/javascript",
+}
+
+// resolveHref turns a link of a file in the zip into the zip entry it points
+// to, external links and fragments only return ""
+func resolveHref(from string, href string) (string, string) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "", ""
+	}
+	if u.Path == "" {
+		return "", u.Fragment
+	}
+	return path.Clean(path.Join(path.Dir(from), u.Path)), u.Fragment
+}
+
+// xhtmlLinks checks a content document is well-formed XML and returns the
+// files it references and the ids it defines
+func xhtmlLinks(data []byte) (refs []string, ids map[string]bool, hasMath bool, hasSvg bool, err error) {
+	ids = map[string]bool{}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return refs, ids, hasMath, hasSvg, nil
+		}
+		if err != nil {
+			return refs, ids, hasMath, hasSvg, err
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "math":
+			hasMath = true
+		case "svg":
+			hasSvg = true
+		}
+		for _, attr := range start.Attr {
+			switch {
+			case attr.Name.Local == "id":
+				ids[attr.Value] = true
+			case attr.Name.Local == "src" && start.Name.Local == "img",
+				attr.Name.Local == "href" && (start.Name.Local == "a" || start.Name.Local == "link"):
+				refs = append(refs, attr.Value)
+			}
+		}
+	}
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// ValidateEpub checks the container, package document, spine, content
+// documents and navigation of an EPUB file
+func ValidateEpub(file string) (*ValidationReport, error) {
+	report := &ValidationReport{Path: file, Problems: []Problem{}}
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		if _, ok := files[f.Name]; ok {
+			report.add("error", f.Name, "stored twice in the zip")
+		}
+		files[f.Name] = f
+	}
+
+	if len(r.File) == 0 || r.File[0].Name != "mimetype" {
+		report.add("error", "mimetype", "must be the first file of the zip")
+	} else {
+		data, err := readZipFile(r.File[0])
+		if err != nil || string(data) != "application/epub+zip" {
+			report.add("error", "mimetype", "must contain application/epub+zip")
+		}
+		if r.File[0].Method != zip.Store {
+			report.add("error", "mimetype", "must be stored uncompressed")
+		}
+	}
+
+	// container.xml points at the package document
+	container, ok := files["META-INF/container.xml"]
+	if !ok {
+		report.add("error", "META-INF/container.xml", "missing")
+		return report.done(), nil
+	}
+	data, err := readZipFile(container)
+	if err != nil {
+		return nil, err
+	}
+	var rootfiles struct {
+		Rootfiles []struct {
+			Path string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(data, &rootfiles); err != nil {
+		report.add("error", "META-INF/container.xml", "not well-formed: %v", err)
+		return report.done(), nil
+	}
+	if len(rootfiles.Rootfiles) == 0 {
+		report.add("error", "META-INF/container.xml", "no rootfile")
+		return report.done(), nil
+	}
+	opfPath := rootfiles.Rootfiles[0].Path
+	opfFile, ok := files[opfPath]
+	if !ok {
+		report.add("error", "META-INF/container.xml", "rootfile %s does not exist", opfPath)
+		return report.done(), nil
+	}
+
+	data, err = readZipFile(opfFile)
+	if err != nil {
+		return nil, err
+	}
+	var opf opfPackage
+	if err := xml.Unmarshal(data, &opf); err != nil {
+		report.add("error", opfPath, "not well-formed: %v", err)
+		return report.done(), nil
+	}
+	if len(opf.Metadata.Identifiers) == 0 {
+		report.add("error", opfPath, "no dc:identifier")
+	}
+	if len(opf.Metadata.Titles) == 0 {
+		report.add("error", opfPath, "no dc:title")
+	}
+	if len(opf.Metadata.Languages) == 0 {
+		report.add("error", opfPath, "no dc:language")
+	}
+
+	// manifest
+	byID := map[string]string{}
+	byPath := map[string]string{}
+	properties := map[string]string{}
+	mediaTypes := map[string]string{}
+	var navs []string
+	for _, item := range opf.Items {
+		if item.ID == "" || item.Href == "" {
+			report.add("error", opfPath, "manifest item %q without id or href", item.ID+item.Href)
+			continue
+		}
+		if _, ok := byID[item.ID]; ok {
+			report.add("error", opfPath, "duplicate manifest id %s", item.ID)
+		}
+		target, _ := resolveHref(opfPath, item.Href)
+		if target == "" {
+			report.add("warning", opfPath, "remote resource %s", item.Href)
+			continue
+		}
+		if other, ok := byPath[target]; ok {
+			report.add("error", opfPath, "%s is in the manifest twice, as %s and %s", item.Href, other, item.ID)
+		}
+		byID[item.ID] = target
+		byPath[target] = item.ID
+		properties[target] = item.Properties
+		mediaTypes[target] = item.MediaType
+		if _, ok := files[target]; !ok {
+			report.add("error", target, "in the manifest but not in the zip")
+		}
+		if want, ok := epubMediaTypes[strings.ToLower(path.Ext(target))]; ok && item.MediaType != want {
+			report.add("error", target, "media type %s, expected %s", item.MediaType, want)
+		}
+		if strings.Contains(" "+item.Properties+" ", " nav ") {
+			navs = append(navs, target)
+		}
+	}
+	for _, f := range r.File {
+		if f.Name == "mimetype" || f.Name == opfPath || strings.HasPrefix(f.Name, "META-INF/") || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if _, ok := byPath[f.Name]; !ok {
+			report.add("warning", f.Name, "not in the manifest")
+		}
+	}
+
+	// spine
+	inSpine := map[string]bool{}
+	if len(opf.Spine.ItemRefs) == 0 {
+		report.add("error", opfPath, "empty spine")
+	}
+	for _, ref := range opf.Spine.ItemRefs {
+		target, ok := byID[ref.IDRef]
+		if !ok {
+			report.add("error", opfPath, "spine item %s is not in the manifest", ref.IDRef)
+			continue
+		}
+		if inSpine[target] {
+			report.add("error", opfPath, "%s is in the spine twice", target)
+		}
+		inSpine[target] = true
+		if mediaTypes[target] != "application/xhtml+xml" && mediaTypes[target] != "image/svg+xml" {
+			report.add("error", target, "in the spine with media type %s", mediaTypes[target])
+		}
+	}
+	if opf.Spine.Toc != "" {
+		if _, ok := byID[opf.Spine.Toc]; !ok {
+			report.add("error", opfPath, "spine toc %s is not in the manifest", opf.Spine.Toc)
+		}
+	}
+	if strings.HasPrefix(opf.Version, "3") && len(navs) != 1 {
+		report.add("error", opfPath, "%d navigation documents, EPUB 3 needs exactly one", len(navs))
+	}
+
+	// content documents: well-formed, properties declared, links resolve
+	ids := map[string]map[string]bool{}
+	refs := map[string][]string{}
+	var documents []string
+	for target, mediaType := range mediaTypes {
+		if mediaType == "application/xhtml+xml" && files[target] != nil {
+			documents = append(documents, target)
+		}
+	}
+	sort.Strings(documents)
+	for _, doc := range documents {
+		data, err := readZipFile(files[doc])
+		if err != nil {
+			return nil, err
+		}
+		links, docIDs, hasMath, hasSvg, err := xhtmlLinks(data)
+		if err != nil {
+			report.add("error", doc, "not well-formed XHTML: %v", err)
+		}
+		ids[doc] = docIDs
+		refs[doc] = links
+		props := " " + properties[doc] + " "
+		if hasMath && !strings.Contains(props, " mathml ") {
+			report.add("error", doc, "contains MathML without the mathml property")
+		}
+		if hasSvg && !strings.Contains(props, " svg ") {
+			report.add("error", doc, "contains SVG without the svg property")
+		}
+	}
+	for _, doc := range documents {
+		for _, href := range refs[doc] {
+			target, fragment := resolveHref(doc, href)
+			if target == "" && fragment == "" {
+				continue
+			}
+			if target == "" {
+				target = doc
+			}
+			if _, ok := files[target]; !ok {
+				report.add("error", doc, "links to missing file %s", href)
+				continue
+			}
+			if _, ok := byPath[target]; !ok {
+				report.add("error", doc, "links to %s which is not in the manifest", href)
+			}
+			if fragment != "" && ids[target] != nil && !ids[target][fragment] {
+				report.add("warning", doc, "links to missing anchor %s", href)
+			}
+		}
+	}
+
+	// navigation only points into the spine
+	for _, nav := range navs {
+		for _, href := range refs[nav] {
+			target, _ := resolveHref(nav, href)
+			if target != "" && files[target] != nil && !inSpine[target] {
+				report.add("error", nav, "navigation points to %s which is not in the spine", href)
+			}
+		}
+		if len(refs[nav]) == 0 {
+			report.add("warning", nav, "navigation has no entries")
+		}
+	}
+	return report.done(), nil
+}
+
+func (r *ValidationReport) done() *ValidationReport {
+	r.Valid = r.Errors == 0
+	return r
+}
+
+// ValidateCommand runs packt validate <file.epub> [--json], it fails when
+// a file has errors
+func ValidateCommand(files []string, asJSON bool) error {
+	if len(files) == 0 {
+		return fmt.Errorf("usage: validate <file.epub> [--json]")
+	}
+	var reports []*ValidationReport
+	invalid := 0
+	for _, file := range files {
+		report, err := ValidateEpub(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if !report.Valid {
+			invalid++
+		}
+		reports = append(reports, report)
+	}
+	if asJSON {
+		if err := printJSON(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, report := range reports {
+			fmt.Print(report.String())
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d files invalid", invalid, len(files))
+	}
+	return nil
+}
+
+// writeValidatedEpub writes the book and checks the file, problems are
+// reported but the book is kept
+func writeValidatedEpub(book *Book, file string) error {
+	if err := WriteEpub(book, file); err != nil {
+		return err
+	}
+	report, err := ValidateEpub(file)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		if p.Severity == "error" {
+			color.Red("Validate : " + p.File + ": " + p.Message)
+		}
+	}
+	if report.Errors > 0 || report.Warnings > 0 {
+		color.Yellow(fmt.Sprintf("Validate : %d errors, %d warnings, run validate %s for details", report.Errors, report.Warnings, file))
+	}
+	return nil
+}
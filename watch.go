@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	bolt "go.etcd.io/bbolt"
+)
+
+var watchBucket = []byte("watch")
+
+// sectionCache is where sections are kept, "" downloads them every time.
+// watch run keeps them between runs, released chapters rarely change, and a
+// book's cache is only cleared by watch rm. library sync keeps them for the
+// run only
+var sectionCache string
+
+// freshChapters are downloaded again even when cached, chapters released in
+// the last runs may still be revised
+var freshChapters map[string]bool
+
+// recentRuns is how many watch runs a released chapter is downloaded again
+const recentRuns = 3
+
+// ChangelogEntry records the chapters that appeared in one watch run
+type ChangelogEntry struct {
+	Time     time.Time `json:"time"`
+	Chapters []string  `json:"chapters"`
+	IDs      []string  `json:"ids,omitempty"` // ids of the chapters
+	Note     string    `json:"note,omitempty"`
+}
+
+// WatchEntry is an early access book rebuilt when new chapters come out
+type WatchEntry struct {
+	ISBN        string           `json:"isbn"`
+	Title       string           `json:"title"`
+	Path        string           `json:"path"`
+	Added       time.Time        `json:"added"`
+	LastRun     time.Time        `json:"lastRun"`
+	Known       []string         `json:"known"`       // chapter ids already built
+	EarlyAccess bool             `json:"earlyAccess"` // at the last run, finished once it is not
+	Changelog   []ChangelogEntry `json:"changelog"`
+}
+
+// cachedSection downloads a section, or reads it from the section cache
+func cachedSection(token string, isbn string, chapterID string, sectionID string) (string, error) {
+	if sectionCache == "" {
+		return DownloadSection(token, isbn, chapterID, sectionID)
+	}
+	path := filepath.Join(sectionCache, SanitizeName(isbn), SanitizeName(chapterID+"-"+sectionID)+".html")
+	if data, err := ioutil.ReadFile(path); err == nil && !freshChapters[chapterID] {
+		return string(data), nil
+	}
+	page, err := DownloadSection(token, isbn, chapterID, sectionID)
+	if err == nil && page != "" && os.MkdirAll(filepath.Dir(path), 0700) == nil {
+		ioutil.WriteFile(path, []byte(page), 0600)
+	}
+	return page, err
+}
+
+// Watches returns the watched books, or the one of an ISBN when it is not ""
+func (l *Library) Watches(isbn string) ([]WatchEntry, error) {
+	var entries []WatchEntry
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(watchBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if isbn != "" && string(k) != isbn {
+				return nil
+			}
+			var entry WatchEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// PutWatch adds or updates a watched book
+func (l *Library) PutWatch(entry WatchEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(watchBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(entry.ISBN), data)
+	})
+}
+
+// DeleteWatch stops watching a book, it tells if the book was watched
+func (l *Library) DeleteWatch(isbn string) (bool, error) {
+	found := false
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(watchBucket)
+		if b == nil || b.Get([]byte(isbn)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(isbn))
+	})
+	return found, err
+}
+
+// updatesSection is the "last updated" page put in front of a watched book
+func updatesSection(entry WatchEntry) Section {
+	var b strings.Builder
+	b.WriteString("<h1>Updates</h1>\n")
+	b.WriteString("<p>Early access edition, last updated " + entry.LastRun.Local().Format("2006-01-02 15:04") + ".</p>\n")
+	for i := len(entry.Changelog) - 1; i >= 0; i-- {
+		change := entry.Changelog[i]
+		b.WriteString("<h2>" + change.Time.Local().Format("2006-01-02") + "</h2>\n")
+		if change.Note != "" {
+			b.WriteString("<p>" + html.EscapeString(change.Note) + "</p>\n")
+		}
+		if len(change.Chapters) > 0 {
+			b.WriteString("<ul>\n")
+			for _, chapter := range change.Chapters {
+				b.WriteString("<li>" + html.EscapeString(chapter) + "</li>\n")
+			}
+			b.WriteString("</ul>\n")
+		}
+	}
+	return Section{Title: "Updates", Level: 0, Part: "preface", Body: b.String()}
+}
+
+// runWatch rebuilds a watched book when chapters were released since the
+// last run, it returns the entry to store
+func runWatch(token string, entry WatchEntry) (WatchEntry, error) {
+	summary, err := GetSummary(entry.ISBN)
+	if err != nil {
+		return entry, err
+	}
+	toc, err := GetToc(entry.ISBN)
+	if err != nil {
+		return entry, err
+	}
+	known := map[string]bool{}
+	for _, id := range entry.Known {
+		known[id] = true
+	}
+	var ids, released, releasedIDs []string
+	for _, part := range toc.Parts() {
+		for _, chapter := range part.Chapters {
+			ids = append(ids, chapter.ID)
+			if !known[chapter.ID] {
+				released = append(released, chapter.Title)
+				releasedIDs = append(releasedIDs, chapter.ID)
+			}
+		}
+	}
+
+	early := summary.EarlyAccess || summary.Releasing
+	finished := entry.EarlyAccess && !early
+	if len(released) == 0 && !finished && !flagSet("force") {
+		fmt.Println("  no new chapters")
+		entry.EarlyAccess = early
+		return entry, nil
+	}
+
+	change := ChangelogEntry{Time: time.Now().UTC(), Chapters: released, IDs: releasedIDs}
+	if len(entry.Changelog) == 0 {
+		change.Note = "First build"
+	} else if finished {
+		change.Note = "Early access finished"
+	}
+	for _, title := range released {
+		fmt.Println("  new chapter: " + title)
+	}
+
+	calibre, err := newCalibreDB()
+	if err != nil {
+		return entry, err
+	}
+	book, err := FetchMetadata(entry.ISBN)
+	if err != nil {
+		return entry, err
+	}
+	if entry.Path == "" {
+		path, write, err := OutputPath(book, writers["epub"].Extension())
+		if err != nil {
+			return entry, err
+		}
+		if !write {
+			color.Yellow("  Skipped : " + path + " already exists")
+			return entry, nil
+		}
+		entry.Path, _ = filepath.Abs(path)
+	}
+	// the final edition and --force do not keep any early access draft
+	freshChapters = map[string]bool{}
+	for _, id := range releasedIDs {
+		freshChapters[id] = true
+	}
+	if finished || flagSet("force") {
+		for _, id := range ids {
+			freshChapters[id] = true
+		}
+	}
+	for i := len(entry.Changelog) - 1; i >= 0 && i >= len(entry.Changelog)-recentRuns; i-- {
+		for _, id := range entry.Changelog[i].IDs {
+			freshChapters[id] = true
+		}
+	}
+	if err := FetchContent(token, book); err != nil {
+		return entry, err
+	}
+
+	updated := entry
+	updated.EarlyAccess = early
+	updated.LastRun = change.Time
+	updated.Changelog = append(append([]ChangelogEntry{}, entry.Changelog...), change)
+	updated.Known = ids
+	book.Sections = append([]Section{updatesSection(updated)}, book.Sections...)
+	if err := writers["epub"].Write(book, entry.Path); err != nil {
+		return entry, err
+	}
+	recordBuild(book, "epub", entry.Path)
+	reportMissing(book)
+	fmt.Println("  Output : " + entry.Path)
+	if calibre != nil {
+		if _, err := calibre.AddToCalibre(book, []string{entry.Path}); err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+// WatchRun checks the watched books, or the one given, for new chapters
+func WatchRun(token string, args []string) error {
+	library, err := OpenLibrary()
+	if err != nil {
+		return err
+	}
+	isbn := ""
+	if len(args) > 0 {
+		isbn = args[0]
+	}
+	entries, err := library.Watches(isbn)
+	library.Close()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New("no book is watched, add one with watch add <isbn>")
+	}
+
+	sectionCache = filepath.Join(cacheDir(), "sections")
+	failed := 0
+	for _, entry := range entries {
+		color.Blue(entry.ISBN + " - " + entry.Title)
+		updated, err := runWatch(token, entry)
+		if err != nil {
+			color.Red("  " + err.Error())
+			failed++
+		}
+		if updated.LastRun.Equal(entry.LastRun) && updated.EarlyAccess == entry.EarlyAccess {
+			continue
+		}
+		// the library is not kept open during downloads, other runs use it
+		library, err := OpenLibrary()
+		if err != nil {
+			return err
+		}
+		err = library.PutWatch(updated)
+		library.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d watched books failed", failed, len(entries))
+	}
+	return nil
+}
+
+// WatchCommand runs packt watch add|list|rm|log, run needs a login and runs
+// from main
+func WatchCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: watch add <isbn> | list | rm <isbn> | log [isbn] | run [isbn]")
+	}
+	library, err := OpenLibrary()
+	if err != nil {
+		return err
+	}
+	defer library.Close()
+
+	switch args[0] {
+	case "add":
+		if len(args) != 2 {
+			return errors.New("usage: watch add <isbn>")
+		}
+		summary, err := GetSummary(args[1])
+		if err != nil {
+			return err
+		}
+		if summary.Title == "" {
+			return fmt.Errorf("%s not found", args[1])
+		}
+		if !summary.EarlyAccess && !summary.Releasing {
+			color.Yellow(summary.Title + " is not in early access, it will be built once")
+		}
+		existing, err := library.Watches(args[1])
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("%s is already watched", args[1])
+		}
+		entry := WatchEntry{ISBN: args[1], Title: summary.Title, Added: time.Now().UTC(),
+			EarlyAccess: summary.EarlyAccess || summary.Releasing}
+		if err := library.PutWatch(entry); err != nil {
+			return err
+		}
+		fmt.Println("Watching " + summary.Title + ", build it with watch run")
+	case "list":
+		entries, err := library.Watches("")
+		if err != nil {
+			return err
+		}
+		if flagSet("json") {
+			return printJSON(entries)
+		}
+		for _, entry := range entries {
+			last := "never"
+			if !entry.LastRun.IsZero() {
+				last = entry.LastRun.Local().Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%s  %3d chapters  updated %s  %s\n", entry.ISBN, len(entry.Known), last, entry.Title)
+		}
+	case "rm":
+		if len(args) != 2 {
+			return errors.New("usage: watch rm <isbn>")
+		}
+		found, err := library.DeleteWatch(args[1])
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%s is not watched", args[1])
+		}
+		// the only way to clear the sections cached for a book
+		os.RemoveAll(filepath.Join(cacheDir(), "sections", SanitizeName(args[1])))
+	case "log":
+		isbn := ""
+		if len(args) > 1 {
+			isbn = args[1]
+		}
+		entries, err := library.Watches(isbn)
+		if err != nil {
+			return err
+		}
+		if flagSet("json") {
+			return printJSON(entries)
+		}
+		for _, entry := range entries {
+			color.Blue(entry.ISBN + " - " + entry.Title)
+			for _, change := range entry.Changelog {
+				line := change.Time.Local().Format("2006-01-02 15:04")
+				if change.Note != "" {
+					line += "  " + change.Note
+				}
+				fmt.Println("  " + line)
+				for _, chapter := range change.Chapters {
+					fmt.Println("    + " + chapter)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown watch command %q, use add, list, rm, log or run", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/fatih/color"
+)
+
+// workDir holds the downloads of this run only, so parallel runs never
+// share or delete each other's files
+var workDir string
+
+var cleanupOnce sync.Once
+
+// cacheDir is $XDG_CACHE_HOME/packt, or the platform cache directory
+func cacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "packt")
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "packt")
+	}
+	return filepath.Join(usr.HomeDir, ".cache", "packt")
+}
+
+// setupWorkspace creates the temp directory of this run under --tmp-dir or
+// the cache directory and removes it again when the run is interrupted
+func setupWorkspace() error {
+	base := flagValue("tmp-dir", cacheDir())
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(base, "run-")
+	if err != nil {
+		return err
+	}
+	workDir = dir
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		cleanupWorkspace()
+		if sig == os.Interrupt {
+			os.Exit(130)
+		}
+		os.Exit(143)
+	}()
+	return nil
+}
+
+// tempPath returns where a temporary file of this run goes
+func tempPath(name string) string {
+	return filepath.Join(workDir, filepath.Base(name))
+}
+
+// cleanupWorkspace removes the temp directory unless --keep-temp is set
+func cleanupWorkspace() {
+	cleanupOnce.Do(func() {
+		if workDir == "" {
+			return
+		}
+		if flagSet("keep-temp") {
+			color.Yellow("Temporary files kept in " + workDir)
+			return
+		}
+		if err := os.RemoveAll(workDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	})
+}
+
+// exit cleans up before leaving, os.Exit skips deferred calls
+func exit(code int) {
+	cleanupWorkspace()
+	os.Exit(code)
+}
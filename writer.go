@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Writer turns a downloaded book into one output format
+type Writer interface {
+	// Extension is appended to the output name, writers producing a
+	// directory return a suffix of their own so formats do not share one
+	Extension() string
+	Write(book *Book, path string) error
+}
+
+// dirWriter is a writer producing a directory, --out names the directory
+// as given without the suffix
+type dirWriter struct {
+	writerFunc
+}
+
+// preparer is implemented by writers that can fail before anything is
+// downloaded, like a missing external converter
+type preparer interface {
+	Prepare() error
+}
+
+type writerFunc struct {
+	ext   string
+	write func(book *Book, path string) error
+}
+
+func (w writerFunc) Extension() string {
+	return w.ext
+}
+
+func (w writerFunc) Write(book *Book, path string) error {
+	return w.write(book, path)
+}
+
+var writers = map[string]Writer{}
+
+// RegisterWriter makes a format available to the get command
+func RegisterWriter(name string, w Writer) {
+	writers[name] = w
+}
+
+// WriterNames returns the registered formats in alphabetical order
+func WriterNames() []string {
+	var names []string
+	for name := range writers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseFormats splits a --format list like "epub,pdf" and checks every
+// format has a writer
+func parseFormats(list string) ([]string, error) {
+	var formats []string
+	for _, format := range strings.Split(list, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if _, ok := writers[format]; !ok {
+			return nil, fmt.Errorf("unknown format %q, available: %s", format, strings.Join(WriterNames(), ", "))
+		}
+		formats = append(formats, format)
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no format given, available: %s", strings.Join(WriterNames(), ", "))
+	}
+	return formats, nil
+}
+
+// DownloadBook downloads a title once and writes it in every format given,
+// it returns the paths it wrote
+func DownloadBook(token string, isbn string, formats []string) ([]string, error) {
+	out := flagValue("out", "")
+	if out != "" && len(formats) > 1 {
+		return nil, errors.New("--out names a single file, use --output-dir and --name-template with several formats")
+	}
+	for _, format := range formats {
+		if p, ok := writers[format].(preparer); ok {
+			if err := p.Prepare(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	book, err := FetchMetadata(isbn)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]string{}
+	for _, format := range formats {
+		ext := writers[format].Extension()
+		path, write, err := OutputPath(book, ext)
+		if out != "" {
+			if _, ok := writers[format].(dirWriter); ok {
+				path, write, err = resolveConflict(out, "")
+			} else {
+				path, write, err = resolveConflict(strings.TrimSuffix(out, ext), ext)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !write {
+			color.Yellow("Skipped : " + path + " already exists")
+			continue
+		}
+		if !flagSet("force") {
+			if entry, ok := upToDate(book, format, path); ok {
+				color.Yellow("Skipped : " + entry.Path + " is up to date, use --force to build it again")
+				continue
+			}
+		}
+		paths[format] = path
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return BuildBook(token, book, formats, paths)
+}
+
+// BuildBook downloads the content of a book and writes the formats that
+// have a path, every file written is recorded in the library and added to
+// the Calibre library when there is one
+func BuildBook(token string, book *Book, formats []string, paths map[string]string) ([]string, error) {
+	calibre, err := newCalibreDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := FetchContent(token, book); err != nil {
+		return nil, err
+	}
+
+	var outputs []string
+	for _, format := range formats {
+		path, ok := paths[format]
+		if !ok {
+			continue
+		}
+		if err := writers[format].Write(book, path); err != nil {
+			return outputs, fmt.Errorf("%s: %v", format, err)
+		}
+		recordBuild(book, format, path)
+		outputs = append(outputs, path)
+	}
+	reportMissing(book)
+	if calibre != nil {
+		id, err := calibre.AddToCalibre(book, outputs)
+		if err != nil {
+			return outputs, err
+		}
+		fmt.Printf("Calibre : book %d in %s\n", id, calibre.Library)
+	}
+	return outputs, nil
+}
+
+// reportMissing lists the images left out of the book
+func reportMissing(book *Book) {
+	if len(book.Missing) == 0 {
+		return
+	}
+	color.Yellow(fmt.Sprintf("%d images could not be downloaded and were replaced by a placeholder:", len(book.Missing)))
+	for _, missing := range book.Missing {
+		fmt.Printf("  %s: %s (%v)\n", missing.Section, missing.URL, missing.Err)
+	}
+}